@@ -1,43 +1,162 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go-learn/fiber/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	// TRACE_OUT=stdout or a file path exports the spans of the demos
+	tp, shutdown, err := tracing.Setup(os.Getenv("TRACE_OUT"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := shutdown(context.Background()); err != nil {
+			logger.Error("tracing", "error", err)
+		}
+	}()
+	nc, err := Connect(ConnConfig{URL: os.Getenv("NATS_URL"), Name: "basic_pub_sub", Logger: logger})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// SIGINT and SIGTERM drain the connection, which ends the demos early, otherwise it is drained
+	// once they are done
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := make(chan error, 1)
+	go func() { drained <- DrainOnSignal(ctx, nc) }()
+	defer func() {
+		cancel()
+		if err := <-drained; err != nil {
+			logger.Error("drain", "error", err)
+		}
+	}()
 
-	url := os.Getenv("NATS_URL")
-	if url == "" {
-		url = nats.DefaultURL
+	// go run ./NATS dlq list | replay <seq>... | replay all
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		if err := dlqCommand(ctx, os.Stdout, nc, os.Args[2:]); err != nil {
+			logger.Error("dlq", "error", err)
+		}
+		return
 	}
 
-	nc, _ := nats.Connect(url)
+	if err := run(nc); err != nil {
+		logger.Error("pub/sub demo", "error", err)
+	}
+	if err := jetStreamDemo(ctx, nc, tp.Tracer(tracerName)); err != nil {
+		logger.Error("jetstream demo", "error", err)
+	}
+}
 
-	defer nc.Drain()
+// Greeting is the payload of greet.* messages
+type Greeting struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+}
 
-	nc.Publish("greet.joe", []byte("hello"))
+func run(nc *nats.Conn) error {
+	if err := DefaultCodec.Publish(nc, "greet.joe", Greeting{From: "joe", Text: "hello"}); err != nil {
+		return err
+	}
 
-	sub, _ := nc.SubscribeSync("greet.*")
+	sub, err := nc.SubscribeSync("greet.*")
+	if err != nil {
+		return err
+	}
+	// Unread messages, such as those of the JetStream demo, would hold up draining the connection
+	defer sub.Unsubscribe()
 
-	msg, _ := sub.NextMsg(10 * time.Millisecond)
+	// Core NATS does not keep messages, the one published before subscribing is lost
 	fmt.Println("subscribed after a publish...")
-	fmt.Printf("msg is nil? %v\n", msg == nil)
+	if _, err := sub.NextMsg(10 * time.Millisecond); errors.Is(err, nats.ErrTimeout) {
+		fmt.Println("no message:", err)
+	} else if err != nil {
+		return err
+	}
 
-	nc.Publish("greet.joe", []byte("hello"))
-	nc.Publish("greet.pam", []byte("hello"))
+	// The subscriber decodes whatever encoding each publisher picked
+	msgpack := Codec{Encoder: MsgpackEncoder}
+	if err := DefaultCodec.Publish(nc, "greet.joe", Greeting{From: "joe", Text: "hello"}); err != nil {
+		return err
+	}
+	if err := msgpack.Publish(nc, "greet.pam", Greeting{From: "pam", Text: "hello"}); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := printNext(sub); err != nil {
+			return err
+		}
+	}
 
-	msg, _ = sub.NextMsg(10 * time.Millisecond)
-	fmt.Printf("msg data: %q on subject %q\n", string(msg.Data), msg.Subject)
+	if err := DefaultCodec.Publish(nc, "greet.bob", Greeting{From: "bob", Text: "hello"}); err != nil {
+		return err
+	}
+	return printNext(sub)
+}
 
-	msg, _ = sub.NextMsg(10 * time.Millisecond)
-	fmt.Printf("msg data: %q on subject %q\n", string(msg.Data), msg.Subject)
+func printNext(sub *nats.Subscription) error {
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		return fmt.Errorf("next message on %s: %w", sub.Subject, err)
+	}
+	var g Greeting
+	if err := Decode(msg.Header, msg.Data, &g); err != nil {
+		return fmt.Errorf("message on %s: %w", msg.Subject, err)
+	}
+	fmt.Printf("msg %+v as %s on subject %q\n", g, msg.Header.Get(headerContentType), msg.Subject)
+	return nil
+}
 
-	nc.Publish("greet.bob", []byte("hello"))
+// jetStreamDemo shows that a stream keeps the message published before consuming,
+// and that the trace of the publisher continues in the consumer
+func jetStreamDemo(ctx context.Context, nc *nats.Conn, tracer trace.Tracer) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+	stream, err := EnsureGreetStream(ctx, js)
+	if err != nil {
+		return err
+	}
+	ctx, span := tracer.Start(ctx, "jetstream demo")
+	defer span.End()
+	msg := nats.NewMsg("greet.joe")
+	if err := DefaultCodec.Encode(msg, Greeting{From: "joe", Text: "hello"}); err != nil {
+		return err
+	}
+	_, pubSpan := StartPublish(ctx, tracer, msg)
+	_, err = js.PublishMsg(ctx, msg)
+	endSpan(pubSpan, err)
+	if err != nil {
+		return err
+	}
 
-	msg, _ = sub.NextMsg(10 * time.Millisecond)
-	fmt.Printf("msg data: %q on subject %q\n", string(msg.Data), msg.Subject)
+	fmt.Println("consuming from the stream after a publish...")
+	cons, err := EnsureConsumer(ctx, stream, ConsumerConfig{Durable: "basic_pub_sub"})
+	if err != nil {
+		return err
+	}
+	next, err := cons.Next(jetstream.FetchMaxWait(time.Second))
+	if err != nil {
+		return err
+	}
+	return TraceMsg(tracer, func(ctx context.Context, msg jetstream.Msg) error {
+		var g Greeting
+		if err := Decode(msg.Headers(), msg.Data(), &g); err != nil {
+			return err
+		}
+		fmt.Printf("msg %+v on subject %q\n", g, msg.Subject())
+		return msg.Ack()
+	})(ctx, next)
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Headers describing how a payload is encoded, as in HTTP
+const (
+	headerContentType     = "Content-Type"
+	headerContentEncoding = "Content-Encoding"
+	headerAccept          = "Accept" // Content type the requester wants the reply in
+)
+
+// Content types of the encoders
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeMsgpack  = "application/msgpack"
+	contentTypeProtobuf = "application/protobuf"
+)
+
+// Encoder encodes values of one content type
+type Encoder interface {
+	ContentType() string
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+// The encoders, messages without a Content-Type are JSON
+var (
+	JSONEncoder     Encoder = jsonEncoder{}
+	MsgpackEncoder  Encoder = msgpackEncoder{}
+	ProtobufEncoder Encoder = protobufEncoder{}
+)
+
+// encoders by content type, with the names other clients commonly send
+var encoders = map[string]Encoder{
+	contentTypeJSON:                   JSONEncoder,
+	contentTypeMsgpack:                MsgpackEncoder,
+	"application/x-msgpack":           MsgpackEncoder,
+	contentTypeProtobuf:               ProtobufEncoder,
+	"application/x-protobuf":          ProtobufEncoder,
+	"application/vnd.google.protobuf": ProtobufEncoder,
+}
+
+// ErrUnsupportedContentType is returned when decoding a message of a content type without encoder
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// EncoderFor returns the encoder of contentType, parameters such as charset are ignored
+func EncoderFor(contentType string) (Encoder, error) {
+	if contentType == "" {
+		return JSONEncoder, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedContentType, contentType)
+	}
+	enc, ok := encoders[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedContentType, contentType)
+	}
+	return enc, nil
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) ContentType() string             { return contentTypeJSON }
+func (jsonEncoder) Encode(v any) ([]byte, error)    { return json.Marshal(v) }
+func (jsonEncoder) Decode(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// msgpackEncoder uses the json tags of structs, so the same types work with both
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) ContentType() string { return contentTypeMsgpack }
+
+func (msgpackEncoder) Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackEncoder) Decode(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// protobufEncoder encodes generated protobuf messages in the binary wire format
+type protobufEncoder struct{}
+
+func (protobufEncoder) ContentType() string { return contentTypeProtobuf }
+
+func (protobufEncoder) Encode(v any) ([]byte, error) {
+	m, ok := protoMessage(v)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufEncoder) Decode(data []byte, v any) error {
+	m, ok := protoMessage(v)
+	if !ok {
+		return fmt.Errorf("protobuf: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// protoMessage returns the message v holds. Generic callers such as Register decode into a
+// pointer to their type parameter, which for generated messages is **T: those are followed,
+// allocating the message if nil. Messages passed by value are copied to a new pointer.
+func protoMessage(v any) (proto.Message, bool) {
+	if m, ok := v.(proto.Message); ok {
+		return m, true
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, false
+	}
+	if rv.Kind() != reflect.Pointer {
+		p := reflect.New(rv.Type())
+		p.Elem().Set(rv)
+		m, ok := p.Interface().(proto.Message)
+		return m, ok
+	}
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() && rv.Elem().Kind() == reflect.Pointer {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		rv = rv.Elem()
+		if m, ok := rv.Interface().(proto.Message); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Codec encodes message payloads with an encoder and gzips the large ones. Decoding follows the
+// headers of each message, so publishers can pick their encoder without subscribers knowing.
+type Codec struct {
+	Encoder Encoder // Defaults to JSON
+	// Payloads larger than this many bytes are gzipped, if it makes them smaller.
+	// 0 takes the default, -1 never compresses.
+	CompressAbove int
+}
+
+// Codec defaults
+const (
+	defaultCompressAbove = 4 * 1024
+	// Decompressed payloads above this are rejected, not to be fooled by a gzip bomb
+	maxDecompressed = 64 * 1024 * 1024
+)
+
+// DefaultCodec encodes JSON and compresses payloads above 4 KiB
+var DefaultCodec = Codec{}
+
+func (c Codec) encoder() Encoder {
+	if c.Encoder == nil {
+		return JSONEncoder
+	}
+	return c.Encoder
+}
+
+// Encode sets the payload of msg to v, with the headers Decode needs
+func (c Codec) Encode(msg *nats.Msg, v any) error {
+	return c.encodeWith(c.encoder(), msg, v)
+}
+
+func (c Codec) encodeWith(enc Encoder, msg *nats.Msg, v any) error {
+	data, err := enc.Encode(v)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", enc.ContentType(), err)
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(headerContentType, enc.ContentType())
+	msg.Header.Del(headerContentEncoding)
+
+	threshold := c.CompressAbove
+	if threshold == 0 {
+		threshold = defaultCompressAbove
+	}
+	if threshold > 0 && len(data) > threshold {
+		if gz, err := gzipData(data); err == nil && len(gz) < len(data) {
+			data = gz
+			msg.Header.Set(headerContentEncoding, "gzip")
+		}
+	}
+	msg.Data = data
+	return nil
+}
+
+// Publish encodes v and publishes it to subject
+func (c Codec) Publish(nc *nats.Conn, subject string, v any) error {
+	msg := nats.NewMsg(subject)
+	if err := c.Encode(msg, v); err != nil {
+		return err
+	}
+	return nc.PublishMsg(msg)
+}
+
+// Respond replies to req with v in the content type the requester asked for with Accept, or else
+// in the content type of the request, falling back to the codec's encoder
+func (c Codec) Respond(req *nats.Msg, v any) error {
+	reply := nats.NewMsg(req.Reply)
+	if err := c.encodeWith(c.replyEncoder(req.Header), reply, v); err != nil {
+		return err
+	}
+	return req.RespondMsg(reply)
+}
+
+func (c Codec) replyEncoder(header nats.Header) Encoder {
+	for _, name := range []string{headerAccept, headerContentType} {
+		if ct := header.Get(name); ct != "" {
+			if enc, err := EncoderFor(ct); err == nil {
+				return enc
+			}
+		}
+	}
+	return c.encoder()
+}
+
+// Decode decodes the payload of a message with the encoder named by its Content-Type header,
+// JSON if it has none, after gunzipping it if its Content-Encoding is gzip
+func Decode(header nats.Header, data []byte, v any) error {
+	enc, err := EncoderFor(header.Get(headerContentType))
+	if err != nil {
+		return err
+	}
+	switch ce := header.Get(headerContentEncoding); ce {
+	case "", "identity":
+	case "gzip":
+		if data, err = gunzipData(data); err != nil {
+			return fmt.Errorf("decode gzip: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported content encoding %q", ce)
+	}
+	if err := enc.Decode(data, v); err != nil {
+		return fmt.Errorf("decode %s: %w", enc.ContentType(), err)
+	}
+	return nil
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipData(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecompressed+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressed {
+		return nil, fmt.Errorf("payload larger than %d bytes", maxDecompressed)
+	}
+	return out, nil
+}
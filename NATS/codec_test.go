@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	long := Greeting{From: "joe", Text: strings.Repeat("hello ", 1000)}
+	for _, tc := range []struct {
+		name     string
+		codec    Codec
+		in       any
+		out      func() any
+		gzip     bool
+		equal    func(in, out any) bool
+		wantType string
+	}{
+		{"json", Codec{}, Greeting{"joe", "hi"}, func() any { return &Greeting{} }, false, greetingsEqual, contentTypeJSON},
+		{"msgpack", Codec{Encoder: MsgpackEncoder}, Greeting{"joe", "hi"}, func() any { return &Greeting{} }, false, greetingsEqual, contentTypeMsgpack},
+		{"protobuf", Codec{Encoder: ProtobufEncoder}, wrapperspb.String("hi"), func() any { return &wrapperspb.StringValue{} },
+			false, func(in, out any) bool { return proto.Equal(in.(proto.Message), out.(proto.Message)) }, contentTypeProtobuf},
+		{"json gzipped", Codec{}, long, func() any { return &Greeting{} }, true, greetingsEqual, contentTypeJSON},
+		{"msgpack gzipped", Codec{Encoder: MsgpackEncoder}, long, func() any { return &Greeting{} }, true, greetingsEqual, contentTypeMsgpack},
+		{"below threshold", Codec{CompressAbove: 1 << 20}, long, func() any { return &Greeting{} }, false, greetingsEqual, contentTypeJSON},
+		{"never compressed", Codec{CompressAbove: -1}, long, func() any { return &Greeting{} }, false, greetingsEqual, contentTypeJSON},
+	} {
+		msg := nats.NewMsg("greet.joe")
+		if err := tc.codec.Encode(msg, tc.in); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := msg.Header.Get(headerContentType); got != tc.wantType {
+			t.Fatalf("%s: expected content type %s, got %s", tc.name, tc.wantType, got)
+		}
+		if gzipped := msg.Header.Get(headerContentEncoding) == "gzip"; gzipped != tc.gzip {
+			t.Fatalf("%s: expected gzip %v, got %v with %d bytes", tc.name, tc.gzip, gzipped, len(msg.Data))
+		}
+		out := tc.out()
+		if err := Decode(msg.Header, msg.Data, out); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !tc.equal(tc.in, out) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.in, out)
+		}
+	}
+}
+
+func greetingsEqual(in, out any) bool {
+	return in.(Greeting) == *out.(*Greeting)
+}
+
+func TestEncoderFor(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		want        Encoder
+	}{
+		{"", JSONEncoder},
+		{"application/json; charset=utf-8", JSONEncoder},
+		{"application/x-msgpack", MsgpackEncoder},
+		{"application/protobuf", ProtobufEncoder},
+		{"text/plain", nil},
+		{"not a ; type", nil},
+	} {
+		got, err := EncoderFor(tc.contentType)
+		if tc.want == nil {
+			if !errors.Is(err, ErrUnsupportedContentType) {
+				t.Fatalf("%q: expected ErrUnsupportedContentType, got %v", tc.contentType, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("%q: expected %s, got %v %v", tc.contentType, tc.want.ContentType(), got, err)
+		}
+	}
+
+	if err := ProtobufEncoder.Decode(nil, &Greeting{}); err == nil {
+		t.Fatal("expected an error decoding protobuf into a struct that is not a proto.Message")
+	}
+}
+
+func TestRPCNegotiatesEncoding(t *testing.T) {
+	nc := connectTest(t, runServer(t))
+	if _, err := Register(nc, "greet.rpc", func(ctx context.Context, req Greeting) (Greeting, error) {
+		return Greeting{From: "server", Text: req.Text + " " + req.From}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := Greeting{From: "server", Text: "hello joe"}
+
+	for _, codec := range []Codec{{}, {Encoder: MsgpackEncoder}} {
+		got, err := CallWith[Greeting, Greeting](context.Background(), nc, codec, "greet.rpc", Greeting{From: "joe", Text: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: expected %+v, got %+v", codec.encoder().ContentType(), want, got)
+		}
+	}
+
+	// Generated messages are pointers, which Register and CallWith decode through a pointer to them
+	if _, err := Register(nc, "greet.rpc.proto", func(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+		return wrapperspb.String(req.GetValue() + " joe"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	pb, err := CallWith[*wrapperspb.StringValue, *wrapperspb.StringValue](context.Background(), nc, Codec{Encoder: ProtobufEncoder}, "greet.rpc.proto", wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pb.GetValue() != "hello joe" {
+		t.Fatalf("%s: expected %q, got %q", contentTypeProtobuf, "hello joe", pb.GetValue())
+	}
+
+	// The reply comes in the content type asked for
+	req := nats.NewMsg("greet.rpc")
+	if err := DefaultCodec.Encode(req, Greeting{From: "joe", Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerAccept, contentTypeMsgpack)
+	reply, err := nc.RequestMsg(req, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := reply.Header.Get(headerContentType); ct != contentTypeMsgpack {
+		t.Fatalf("expected a %s reply, got %q", contentTypeMsgpack, ct)
+	}
+
+	// Plain JSON without headers still works
+	reply, err = nc.Request("greet.rpc", []byte(`{"from":"joe","text":"hello"}`), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Greeting
+	if err := Decode(reply.Header, reply.Data, &got); err != nil || got != want {
+		t.Fatalf("expected %+v, got %+v %v", want, got, err)
+	}
+
+	// Unknown content types are bad requests
+	req = nats.NewMsg("greet.rpc")
+	req.Header.Set(headerContentType, "text/plain")
+	req.Data = []byte("hello")
+	if reply, err = nc.RequestMsg(req, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if code := reply.Header.Get(headerErrorCode); code != CodeBadRequest {
+		t.Fatalf("expected %s, got %q", CodeBadRequest, code)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ConnConfig configures Connect, zero fields take the defaults below
+type ConnConfig struct {
+	URL    string
+	Name   string // Shown by the server in connection lists
+	Logger *slog.Logger
+	// Reconnect attempts wait MinReconnectWait, doubling up to MaxReconnectWait
+	MinReconnectWait time.Duration
+	MaxReconnectWait time.Duration
+	// Bytes of publishes buffered while reconnecting, publishing fails once it is full
+	ReconnectBuffer int
+	DrainTimeout    time.Duration
+}
+
+// Connection defaults
+const (
+	defaultMinReconnectWait = 100 * time.Millisecond
+	defaultMaxReconnectWait = 5 * time.Second
+	defaultReconnectBuffer  = 8 * 1024 * 1024
+	defaultDrainTimeout     = 10 * time.Second
+)
+
+// Connect connects to NATS and keeps reconnecting forever with exponential backoff, also if the
+// server is down at startup. Connection events and asynchronous errors (e.g. slow consumers) are
+// logged. opts are applied last and can override any of this.
+func Connect(cfg ConnConfig, opts ...nats.Option) (*nats.Conn, error) {
+	if cfg.URL == "" {
+		cfg.URL = nats.DefaultURL
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.MinReconnectWait == 0 {
+		cfg.MinReconnectWait = defaultMinReconnectWait
+	}
+	if cfg.MaxReconnectWait == 0 {
+		cfg.MaxReconnectWait = defaultMaxReconnectWait
+	}
+	if cfg.ReconnectBuffer == 0 {
+		cfg.ReconnectBuffer = defaultReconnectBuffer
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+	log := cfg.Logger.With("name", cfg.Name)
+
+	options := []nats.Option{
+		nats.Name(cfg.Name),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.CustomReconnectDelay(func(attempts int) time.Duration {
+			return backoff(attempts, cfg.MinReconnectWait, cfg.MaxReconnectWait)
+		}),
+		nats.ReconnectBufSize(cfg.ReconnectBuffer),
+		nats.DrainTimeout(cfg.DrainTimeout),
+		nats.ConnectHandler(func(nc *nats.Conn) {
+			log.Info("nats connected", "url", nc.ConnectedUrlRedacted())
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			// err is nil when the connection is closed on purpose
+			if err != nil {
+				log.Warn("nats disconnected", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Info("nats reconnected", "url", nc.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			log.Info("nats connection closed")
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			attrs := []any{"error", err}
+			if sub != nil {
+				attrs = append(attrs, "subject", sub.Subject)
+			}
+			log.Error("nats async error", attrs...)
+		}),
+	}
+	nc, err := nats.Connect(cfg.URL, append(options, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", cfg.URL, err)
+	}
+	return nc, nil
+}
+
+// backoff returns the wait before reconnect attempt n (1-based): min doubled per attempt, at most max
+func backoff(n int, min, max time.Duration) time.Duration {
+	wait := min
+	for i := 1; i < n && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+// Drain drains nc (subscriptions finish their pending messages, then buffered publishes are
+// flushed) and waits until the connection is closed. The drain timeout is the connection's.
+func Drain(nc *nats.Conn) error {
+	closed := make(chan struct{})
+	prev := nc.ClosedHandler()
+	nc.SetClosedHandler(func(c *nats.Conn) {
+		if prev != nil {
+			prev(c)
+		}
+		close(closed)
+	})
+	if err := nc.Drain(); err != nil {
+		if errors.Is(err, nats.ErrConnectionClosed) {
+			return nil
+		}
+		// Can't drain while reconnecting, what is still buffered is lost
+		nc.Close()
+		return fmt.Errorf("drain: %w", err)
+	}
+	// The client gives up draining after its DrainTimeout, closing the connection anyway
+	select {
+	case <-closed:
+	case <-time.After(nc.Opts.DrainTimeout + time.Second):
+		nc.Close()
+		return fmt.Errorf("drain: %w", nats.ErrDrainTimeout)
+	}
+	if err := nc.LastError(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+		return fmt.Errorf("drain: %w", err)
+	}
+	return nil
+}
+
+// DrainOnSignal blocks until SIGINT or SIGTERM is received or ctx is done, then drains nc
+func DrainOnSignal(ctx context.Context, nc *nats.Conn) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	return Drain(nc)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// logBuffer collects log output written from the client's callback goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBackoff(t *testing.T) {
+	min, max := 100*time.Millisecond, time.Second
+	for _, tc := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	} {
+		if got := backoff(tc.attempt, min, max); got != tc.want {
+			t.Fatalf("attempt %d: expected %v, got %v", tc.attempt, tc.want, got)
+		}
+	}
+}
+
+func TestReconnectBuffersPublishes(t *testing.T) {
+	s := runServer(t)
+	port := s.Addr().(*net.TCPAddr).Port
+	var logs logBuffer
+	nc, err := Connect(ConnConfig{
+		URL:              s.ClientURL(),
+		Logger:           slog.New(slog.NewTextHandler(&logs, nil)),
+		MinReconnectWait: 10 * time.Millisecond,
+		MaxReconnectWait: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("greet.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Shutdown()
+	deadline := time.Now().Add(5 * time.Second)
+	for nc.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Buffered until the connection is back
+	if err := nc.Publish("greet.joe", []byte("hello")); err != nil {
+		t.Fatalf("expected the publish to be buffered, got %v", err)
+	}
+
+	startServer(t, &server.Options{Port: port})
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("expected the buffered message after reconnecting, got %v", err)
+	}
+	if string(msg.Data) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", msg.Data)
+	}
+	for _, event := range []string{"nats connected", "nats disconnected", "nats reconnected"} {
+		if !strings.Contains(logs.String(), event) {
+			t.Fatalf("expected %q to be logged, got %s", event, logs.String())
+		}
+	}
+}
+
+func TestDrainOnSignal(t *testing.T) {
+	s := runServer(t)
+	nc, err := Connect(ConnConfig{URL: s.ClientURL(), Logger: slog.New(slog.NewTextHandler(&logBuffer{}, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages already received by a slow subscriber are handled before the connection closes
+	var mu sync.Mutex
+	var handled int
+	if _, err := nc.Subscribe("work", func(*nats.Msg) {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := nc.Publish("work", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := DrainOnSignal(ctx, nc); err != nil {
+		t.Fatal(err)
+	}
+	if !nc.IsClosed() {
+		t.Fatal("expected the connection to be closed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if handled != 10 {
+		t.Fatalf("expected 10 messages handled before closing, got %d", handled)
+	}
+}
+
+func TestPubSubDemo(t *testing.T) {
+	nc := connectTest(t, runJetStream(t))
+	if err := run(nc); err != nil {
+		t.Fatal(err)
+	}
+	if err := jetStreamDemo(context.Background(), nc, noop.NewTracerProvider().Tracer("")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Dead letters are republished to the original subject with this prefix, into a stream of their
+// own: in the original stream, consumers without a filter would get them and fail them again.
+const (
+	dlqStream   = "DLQ"
+	dlqPrefix   = "dlq."
+	dlqSubjects = dlqPrefix + ">"
+)
+
+// Headers describing why a message was dead-lettered, the original headers are kept as well
+const (
+	headerDLQSubject  = "Dlq-Subject"
+	headerDLQStream   = "Dlq-Stream"
+	headerDLQSequence = "Dlq-Stream-Seq"
+	headerDLQConsumer = "Dlq-Consumer"
+	headerDLQAttempts = "Dlq-Attempts"
+	headerDLQError    = "Dlq-Error"
+	headerDLQFailedAt = "Dlq-Failed-At"
+)
+
+// RetryPolicy says how often and how long apart a failing message is retried before it is dead-lettered
+type RetryPolicy struct {
+	MaxAttempts int
+	// Retries wait InitialDelay, doubling up to MaxDelay
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// EnsureDLQStream creates the dead letter stream or updates it to the current config
+func EnsureDLQStream(ctx context.Context, js jetstream.JetStream) (jetstream.Stream, error) {
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     dlqStream,
+		Subjects: []string{dlqSubjects},
+		Storage:  jetstream.FileStorage,
+		MaxAge:   30 * 24 * time.Hour,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create stream %s: %w", dlqStream, err)
+	}
+	return stream, nil
+}
+
+// Default retry policy
+var defaultRetryPolicy = RetryPolicy{MaxAttempts: 5, InitialDelay: time.Second, MaxDelay: time.Minute}
+
+// ConsumeWithRetry is Consume with retries: a failed message is redelivered after the policy's
+// backoff (NakWithDelay) and after MaxAttempts published to dlq.<subject> and acked.
+// The consumer's MaxDeliver must be -1 or at least MaxAttempts, or the server gives up first.
+func ConsumeWithRetry(ctx context.Context, js jetstream.JetStream, cons jetstream.Consumer, policy RetryPolicy, handler MsgHandler) error {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultRetryPolicy.MaxAttempts
+	}
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = defaultRetryPolicy.InitialDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = defaultRetryPolicy.MaxDelay
+	}
+	if _, err := EnsureDLQStream(ctx, js); err != nil {
+		return err
+	}
+	cc, err := cons.Consume(func(msg jetstream.Msg) {
+		err := handler(ctx, msg)
+		if err == nil {
+			msg.Ack()
+			return
+		}
+		md, mdErr := msg.Metadata()
+		if mdErr != nil {
+			msg.Nak()
+			return
+		}
+		attempt := int(md.NumDelivered)
+		if attempt < policy.MaxAttempts {
+			msg.NakWithDelay(backoff(attempt, policy.InitialDelay, policy.MaxDelay))
+			return
+		}
+		if err := deadLetter(ctx, js, msg, md, err); err != nil {
+			// Keep the message until it can be dead-lettered
+			msg.NakWithDelay(policy.MaxDelay)
+			return
+		}
+		msg.Ack()
+	})
+	if err != nil {
+		return fmt.Errorf("consume: %w", err)
+	}
+	<-ctx.Done()
+	cc.Stop()
+	return nil
+}
+
+// deadLetter publishes msg to its dead letter subject with the failure in headers
+func deadLetter(ctx context.Context, js jetstream.JetStream, msg jetstream.Msg, md *jetstream.MsgMetadata, cause error) error {
+	dl := nats.NewMsg(dlqPrefix + msg.Subject())
+	dl.Data = msg.Data()
+	for k, v := range msg.Headers() {
+		dl.Header[k] = v
+	}
+	dl.Header.Set(headerDLQSubject, msg.Subject())
+	dl.Header.Set(headerDLQStream, md.Stream)
+	dl.Header.Set(headerDLQSequence, strconv.FormatUint(md.Sequence.Stream, 10))
+	dl.Header.Set(headerDLQConsumer, md.Consumer)
+	dl.Header.Set(headerDLQAttempts, strconv.FormatUint(md.NumDelivered, 10))
+	dl.Header.Set(headerDLQError, cause.Error())
+	dl.Header.Set(headerDLQFailedAt, time.Now().UTC().Format(time.RFC3339Nano))
+	if _, err := js.PublishMsg(ctx, dl); err != nil {
+		return fmt.Errorf("dead-letter %s: %w", msg.Subject(), err)
+	}
+	return nil
+}
+
+// DeadLetters returns the dead letters in stream whose subject matches filter, e.g. dlq.greet.>
+func DeadLetters(ctx context.Context, stream jetstream.Stream, filter string) ([]*jetstream.RawStreamMsg, error) {
+	info, err := stream.Info(ctx, jetstream.WithSubjectFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	var n uint64
+	for _, count := range info.State.Subjects {
+		n += count
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	cons, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{FilterSubjects: []string{filter}})
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	var msgs []*jetstream.RawStreamMsg
+	for uint64(len(msgs)) < n {
+		msg, err := cons.Next(jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("dead letters: %w", err)
+		}
+		md, err := msg.Metadata()
+		if err != nil {
+			return nil, fmt.Errorf("dead letters: %w", err)
+		}
+		msgs = append(msgs, &jetstream.RawStreamMsg{
+			Subject: msg.Subject(), Sequence: md.Sequence.Stream, Header: msg.Headers(), Data: msg.Data(), Time: md.Timestamp,
+		})
+		if md.NumPending == 0 {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// Replay republishes a dead letter to its original subject, without the dead letter headers,
+// and removes it from the stream. The republished message's ID is derived from the dead letter,
+// so replaying again after a failed delete is deduplicated within the stream's duplicate window.
+func Replay(ctx context.Context, js jetstream.JetStream, stream jetstream.Stream, seq uint64) error {
+	dl, err := stream.GetMsg(ctx, seq)
+	if err != nil {
+		return fmt.Errorf("replay %d: %w", seq, err)
+	}
+	subject := dl.Header.Get(headerDLQSubject)
+	if subject == "" {
+		return fmt.Errorf("replay %d: %s is not a dead letter", seq, dl.Subject)
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = dl.Data
+	for k, v := range dl.Header {
+		if !strings.HasPrefix(k, "Dlq-") {
+			msg.Header[k] = v
+		}
+	}
+	// Replaces the original ID, the stream may still remember it and drop the replay
+	msg.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("replay-%s-%d", dlqStream, seq))
+	if _, err := js.PublishMsg(ctx, msg); err != nil {
+		return fmt.Errorf("replay %d: %w", seq, err)
+	}
+	if err := stream.DeleteMsg(ctx, seq); err != nil {
+		return fmt.Errorf("replay %d: %w", seq, err)
+	}
+	return nil
+}
+
+// Filter of the dlq command, the dead letters of the greet stream
+const greetDLQ = dlqPrefix + greetSubjects
+
+// dlqCommand implements go run ./NATS dlq list | replay <seq>... | replay all
+func dlqCommand(ctx context.Context, w io.Writer, nc *nats.Conn, args []string) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+	stream, err := EnsureDLQStream(ctx, js)
+	if err != nil {
+		return err
+	}
+	usage := errors.New("usage: dlq list | replay <seq>... | replay all")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "list":
+		msgs, err := DeadLetters(ctx, stream, greetDLQ)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			fmt.Fprintf(w, "%d\t%s\tattempts=%s\tfailed_at=%s\terror=%q\tdata=%q\n", m.Sequence,
+				m.Header.Get(headerDLQSubject), m.Header.Get(headerDLQAttempts), m.Header.Get(headerDLQFailedAt),
+				m.Header.Get(headerDLQError), m.Data)
+		}
+		fmt.Fprintf(w, "%d dead letters\n", len(msgs))
+		return nil
+	case "replay":
+		var seqs []uint64
+		switch {
+		case len(args) == 2 && args[1] == "all":
+			msgs, err := DeadLetters(ctx, stream, greetDLQ)
+			if err != nil {
+				return err
+			}
+			for _, m := range msgs {
+				seqs = append(seqs, m.Sequence)
+			}
+		case len(args) > 1:
+			for _, arg := range args[1:] {
+				seq, err := strconv.ParseUint(arg, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid sequence %q", arg)
+				}
+				seqs = append(seqs, seq)
+			}
+		default:
+			return usage
+		}
+		for _, seq := range seqs {
+			if err := Replay(ctx, js, stream, seq); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "replayed %d dead letters\n", len(seqs))
+		return nil
+	default:
+		return usage
+	}
+}
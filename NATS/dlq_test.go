@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestDeadLetters(t *testing.T) {
+	s := runJetStream(t)
+	nc := connectTest(t, s)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := EnsureGreetStream(ctx, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No filter, dead letters are kept out of the greet stream. As many deliveries as attempts are enough.
+	cons, err := EnsureConsumer(ctx, stream, ConsumerConfig{Durable: "greeter", MaxDeliver: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var attempts []time.Time
+	fixed := false
+	handled := make(chan string, 10)
+	consumeCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go ConsumeWithRetry(consumeCtx, js, cons, RetryPolicy{MaxAttempts: 3, InitialDelay: 50 * time.Millisecond, MaxDelay: 80 * time.Millisecond},
+		func(_ context.Context, msg jetstream.Msg) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if msg.Subject() == "greet.broken" && !fixed {
+				attempts = append(attempts, time.Now())
+				return errors.New("cannot greet")
+			}
+			handled <- msg.Subject()
+			return nil
+		})
+
+	if _, err := js.Publish(ctx, "greet.broken", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	dlqStream, err := EnsureDLQStream(ctx, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead []*jetstream.RawStreamMsg
+	for len(dead) == 0 {
+		if dead, err = DeadLetters(ctx, dlqStream, greetDLQ); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts before dead-lettering, got %d", len(attempts))
+	}
+	// Retries wait 50ms, then 80ms (capped from 100ms)
+	for i, min := range []time.Duration{50 * time.Millisecond, 80 * time.Millisecond} {
+		if d := attempts[i+1].Sub(attempts[i]); d < min {
+			t.Fatalf("expected retry %d after at least %v, got %v", i+1, min, d)
+		}
+	}
+	fixed = true
+	mu.Unlock()
+
+	dl := dead[0]
+	for header, want := range map[string]string{
+		headerDLQSubject:  "greet.broken",
+		headerDLQStream:   greetStream,
+		headerDLQSequence: "1",
+		headerDLQConsumer: "greeter",
+		headerDLQAttempts: "3",
+		headerDLQError:    "cannot greet",
+	} {
+		if got := dl.Header.Get(header); got != want {
+			t.Fatalf("expected %s %q, got %q", header, want, got)
+		}
+	}
+	if dl.Subject != "dlq.greet.broken" || string(dl.Data) != "hello" {
+		t.Fatalf("expected hello on dlq.greet.broken, got %q on %s", dl.Data, dl.Subject)
+	}
+	if info, err := stream.Info(ctx); err != nil || info.State.Msgs != 1 {
+		t.Fatalf("expected the greet stream to only hold the original message, got %+v, %v", info.State, err)
+	}
+
+	var out bytes.Buffer
+	if err := dlqCommand(ctx, &out, nc, []string{"list"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "greet.broken\tattempts=3") || !strings.Contains(out.String(), "1 dead letters") {
+		t.Fatalf("expected the dead letter to be listed, got %q", out.String())
+	}
+	if err := dlqCommand(ctx, &out, nc, []string{"replay", "all"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case subject := <-handled:
+		if subject != "greet.broken" {
+			t.Fatalf("expected the replayed greet.broken, got %s", subject)
+		}
+	case <-ctx.Done():
+		t.Fatal("expected the replayed message to be handled")
+	}
+	if dead, err := DeadLetters(ctx, dlqStream, greetDLQ); err != nil || len(dead) != 0 {
+		t.Fatalf("expected no dead letters after replaying, got %d, %v", len(dead), err)
+	}
+
+	for _, args := range [][]string{nil, {"replay"}, {"replay", "x"}, {"purge"}} {
+		if err := dlqCommand(ctx, &out, nc, args); err == nil {
+			t.Fatalf("expected %v to fail", args)
+		}
+	}
+}
+
+// A replay whose delete failed can be retried without publishing the message twice
+func TestReplayDeduplicates(t *testing.T) {
+	s := runJetStream(t)
+	nc := connectTest(t, s)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := EnsureGreetStream(ctx, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlqStream, err := EnsureDLQStream(ctx, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := nats.NewMsg("dlq.greet.joe")
+	dl.Header.Set(headerDLQSubject, "greet.joe")
+	dl.Data = []byte("hello")
+	ack, err := js.PublishMsg(ctx, dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A first replay republished the message, then failed to delete the dead letter
+	first := nats.NewMsg("greet.joe")
+	first.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("replay-%s-%d", dlqStream.CachedInfo().Config.Name, ack.Sequence))
+	first.Data = dl.Data
+	if _, err := js.PublishMsg(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := Replay(ctx, js, dlqStream, ack.Sequence); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := stream.Info(ctx); err != nil || info.State.Msgs != 1 {
+		t.Fatalf("expected the replay to be deduplicated, got %+v, %v", info.State, err)
+	}
+	if dead, err := DeadLetters(ctx, dlqStream, greetDLQ); err != nil || len(dead) != 0 {
+		t.Fatalf("expected the dead letter to be deleted, got %d, %v", len(dead), err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runServer starts an embedded NATS server on a random port, stopped when the test ends
+func runServer(t testing.TB) *server.Server {
+	t.Helper()
+	return startServer(t, &server.Options{Port: -1})
+}
+
+// runJetStream starts an embedded NATS server with JetStream enabled, storing in a temporary directory
+func runJetStream(t testing.TB) *server.Server {
+	t.Helper()
+	return startServer(t, &server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+}
+
+// startServer starts an embedded NATS server with opts on localhost, stopped when the test ends
+func startServer(t testing.TB, opts *server.Options) *server.Server {
+	t.Helper()
+	opts.Host = "127.0.0.1"
+	opts.NoLog = true
+	opts.NoSigs = true
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("embedded NATS server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// connectTest connects to s, the connection is closed when the test ends
+func connectTest(t testing.TB, s *server.Server) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Stream persisting every greet.> message, so consumers also get what was published before they started
+const (
+	greetStream   = "GREET"
+	greetSubjects = "greet.>"
+)
+
+// EnsureGreetStream creates the greet stream or updates it to the current config
+func EnsureGreetStream(ctx context.Context, js jetstream.JetStream) (jetstream.Stream, error) {
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     greetStream,
+		Subjects: []string{greetSubjects},
+		Storage:  jetstream.FileStorage,
+		MaxAge:   7 * 24 * time.Hour,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create stream %s: %w", greetStream, err)
+	}
+	return stream, nil
+}
+
+// ConsumerConfig configures a durable pull consumer, zero fields take the defaults below
+type ConsumerConfig struct {
+	Durable       string // Name under which the server keeps the consumer's position
+	FilterSubject string // Only messages on this subject, e.g. greet.joe
+	AckWait       time.Duration
+	MaxDeliver    int // Deliveries of a message before the server gives up on it, -1 for no limit
+	// Replay from a stream sequence or a point in time instead of the beginning of the stream.
+	// Only applies when the consumer is created.
+	StartSequence uint64
+	StartTime     time.Time
+}
+
+// Consumer defaults
+const (
+	defaultAckWait    = 30 * time.Second
+	defaultMaxDeliver = 5
+)
+
+// EnsureConsumer creates the durable consumer on stream, or updates it if it already exists
+func EnsureConsumer(ctx context.Context, stream jetstream.Stream, cfg ConsumerConfig) (jetstream.Consumer, error) {
+	if cfg.AckWait == 0 {
+		cfg.AckWait = defaultAckWait
+	}
+	if cfg.MaxDeliver == 0 {
+		cfg.MaxDeliver = defaultMaxDeliver
+	}
+	cc := jetstream.ConsumerConfig{
+		Durable:       cfg.Durable,
+		FilterSubject: cfg.FilterSubject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxDeliver:    cfg.MaxDeliver,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	}
+	switch {
+	case cfg.StartSequence > 0 && !cfg.StartTime.IsZero():
+		return nil, errors.New("consumer: set either StartSequence or StartTime")
+	case cfg.StartSequence > 0:
+		cc.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cc.OptStartSeq = cfg.StartSequence
+	case !cfg.StartTime.IsZero():
+		cc.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		cc.OptStartTime = &cfg.StartTime
+	}
+	cons, err := stream.CreateOrUpdateConsumer(ctx, cc)
+	if err != nil {
+		return nil, fmt.Errorf("create consumer %s: %w", cfg.Durable, err)
+	}
+	return cons, nil
+}
+
+// MsgHandler handles a JetStream message, returning an error has it redelivered
+type MsgHandler func(ctx context.Context, msg jetstream.Msg) error
+
+// Consume handles the consumer's messages until ctx is done. Messages are acked when the handler
+// succeeds and nacked, so redelivered right away, when it fails. The consumer's MaxDeliver bounds
+// the attempts.
+func Consume(ctx context.Context, cons jetstream.Consumer, handler MsgHandler) error {
+	// Failed acks and nacks are not reported: the message is redelivered after AckWait either way
+	cc, err := cons.Consume(func(msg jetstream.Msg) {
+		if err := handler(ctx, msg); err != nil {
+			msg.Nak()
+			return
+		}
+		msg.Ack()
+	})
+	if err != nil {
+		return fmt.Errorf("consume: %w", err)
+	}
+	<-ctx.Done()
+	cc.Stop()
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newTestStream connects to a JetStream server and creates the greet stream
+func newTestStream(t *testing.T) (jetstream.JetStream, jetstream.Stream) {
+	t.Helper()
+	js, err := jetstream.New(connectTest(t, runJetStream(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := EnsureGreetStream(context.Background(), js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js, stream
+}
+
+// publishGreets publishes "hello" to each subject and returns the stream sequences
+func publishGreets(t *testing.T, js jetstream.JetStream, subjects ...string) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	for _, subject := range subjects {
+		ack, err := js.Publish(context.Background(), subject, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, ack.Sequence)
+	}
+	return seqs
+}
+
+// collect consumes until n messages were handled successfully or the timeout passes,
+// returning their subjects in the order they were handled
+func collect(t *testing.T, cons jetstream.Consumer, n int, handler MsgHandler) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var subjects []string
+	err := Consume(ctx, cons, func(ctx context.Context, msg jetstream.Msg) error {
+		if handler != nil {
+			if err := handler(ctx, msg); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if subjects = append(subjects, msg.Subject()); len(subjects) == n {
+			cancel()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return subjects
+}
+
+func TestJetStreamKeepsEarlyMessages(t *testing.T) {
+	js, stream := newTestStream(t)
+	ctx := context.Background()
+
+	// Published before the consumer exists
+	publishGreets(t, js, "greet.joe", "greet.pam")
+	cons, err := EnsureConsumer(ctx, stream, ConsumerConfig{Durable: "greeter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(t, cons, 2, nil); len(got) != 2 || got[0] != "greet.joe" || got[1] != "greet.pam" {
+		t.Fatalf("expected greet.joe and greet.pam, got %v", got)
+	}
+
+	// The durable consumer resumes after the last acked message
+	publishGreets(t, js, "greet.bob")
+	cons, err = EnsureConsumer(ctx, stream, ConsumerConfig{Durable: "greeter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(t, cons, 1, nil); len(got) != 1 || got[0] != "greet.bob" {
+		t.Fatalf("expected only greet.bob, got %v", got)
+	}
+}
+
+func TestJetStreamRedelivery(t *testing.T) {
+	js, stream := newTestStream(t)
+	ctx := context.Background()
+	publishGreets(t, js, "greet.flaky", "greet.broken", "greet.joe")
+	cons, err := EnsureConsumer(ctx, stream, ConsumerConfig{Durable: "retry", MaxDeliver: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var settled *time.Timer
+	err = Consume(ctx, cons, func(_ context.Context, msg jetstream.Msg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		subject := msg.Subject()
+		attempts[subject]++
+		if attempts["greet.broken"] == 3 && attempts["greet.joe"] == 1 && settled == nil {
+			// Give a wrongful fourth delivery the time to arrive
+			settled = time.AfterFunc(200*time.Millisecond, cancel)
+		}
+		switch {
+		case subject == "greet.broken":
+			return errors.New("always fails")
+		case subject == "greet.flaky" && attempts[subject] < 2:
+			return errors.New("fails once")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["greet.flaky"] != 2 || attempts["greet.broken"] != 3 || attempts["greet.joe"] != 1 {
+		t.Fatalf("expected 2 attempts for greet.flaky, 3 for greet.broken and 1 for greet.joe, got %v", attempts)
+	}
+}
+
+func TestJetStreamReplay(t *testing.T) {
+	js, stream := newTestStream(t)
+	ctx := context.Background()
+	seqs := publishGreets(t, js, "greet.joe", "greet.pam")
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	publishGreets(t, js, "greet.bob")
+
+	for _, tc := range []struct {
+		name string
+		cfg  ConsumerConfig
+		want []string
+	}{
+		{"all", ConsumerConfig{Durable: "all"}, []string{"greet.joe", "greet.pam", "greet.bob"}},
+		{"from sequence", ConsumerConfig{Durable: "seq", StartSequence: seqs[1]}, []string{"greet.pam", "greet.bob"}},
+		{"from time", ConsumerConfig{Durable: "time", StartTime: since}, []string{"greet.bob"}},
+		{"filtered", ConsumerConfig{Durable: "joe", FilterSubject: "greet.joe"}, []string{"greet.joe"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cons, err := EnsureConsumer(ctx, stream, tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := collect(t, cons, len(tc.want), nil)
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("expected %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+
+	if _, err := EnsureConsumer(ctx, stream, ConsumerConfig{Durable: "both", StartSequence: 1, StartTime: since}); err == nil {
+		t.Fatal("expected an error for both a start sequence and time")
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ConfigStore keeps a config struct as JSON under a key of a KV bucket and reloads it whenever
+// the key changes, so every replica sees the same config without restarting
+type ConfigStore[T any] struct {
+	kv      jetstream.KeyValue
+	key     string
+	logger  *slog.Logger
+	watcher jetstream.KeyWatcher
+	done    chan struct{}
+
+	mu        sync.RWMutex
+	value     T
+	revision  uint64
+	listeners []func(T)
+}
+
+// Revisions of a config kept by the bucket
+const configHistory = 5
+
+// OpenConfigStore creates bucket if needed and watches key. It returns once the current value,
+// if any, is loaded: until the key is put the config is the zero T.
+func OpenConfigStore[T any](ctx context.Context, js jetstream.JetStream, bucket, key string, logger *slog.Logger) (*ConfigStore[T], error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: bucket, History: configHistory})
+	if err != nil {
+		return nil, fmt.Errorf("config bucket %s: %w", bucket, err)
+	}
+	// The watcher outlives ctx, it runs until Close
+	w, err := kv.Watch(context.Background(), key)
+	if err != nil {
+		return nil, fmt.Errorf("watch config %s: %w", key, err)
+	}
+	s := &ConfigStore[T]{kv: kv, key: key, logger: logger.With("bucket", bucket, "key", key), watcher: w, done: make(chan struct{})}
+
+	// The watcher sends the current value, then nil once it is up to date
+	for loaded := false; !loaded; {
+		select {
+		case e, ok := <-w.Updates():
+			if !ok {
+				return nil, fmt.Errorf("watch config %s: watcher stopped", key)
+			}
+			if e == nil {
+				loaded = true
+			} else {
+				s.apply(e)
+			}
+		case <-ctx.Done():
+			w.Stop()
+			return nil, fmt.Errorf("load config %s: %w", key, ctx.Err())
+		}
+	}
+	go s.watch()
+	return s, nil
+}
+
+func (s *ConfigStore[T]) watch() {
+	defer close(s.done)
+	for e := range s.watcher.Updates() {
+		if e != nil {
+			s.apply(e)
+		}
+	}
+}
+
+// apply loads a new revision of the config. Deletes and values that don't decode keep the previous
+// config, a replica never runs with a config it can't read.
+func (s *ConfigStore[T]) apply(e jetstream.KeyValueEntry) {
+	if e.Operation() != jetstream.KeyValuePut {
+		s.logger.Warn("config deleted, keeping the previous one", "revision", e.Revision())
+		return
+	}
+	var v T
+	if err := json.Unmarshal(e.Value(), &v); err != nil {
+		s.logger.Error("invalid config, keeping the previous one", "revision", e.Revision(), "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.value, s.revision = v, e.Revision()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, fn := range listeners {
+		fn(v)
+	}
+}
+
+// Get returns the current config and the revision it was loaded from, 0 if the key was never put
+func (s *ConfigStore[T]) Get() (T, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value, s.revision
+}
+
+// OnChange registers fn, called with every config loaded from now on. Calls happen one at a time,
+// on the watcher's goroutine.
+func (s *ConfigStore[T]) OnChange(fn func(T)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Put stores v as the config of every replica and returns its revision
+func (s *ConfigStore[T]) Put(ctx context.Context, v T) (uint64, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("put config %s: %w", s.key, err)
+	}
+	rev, err := s.kv.Put(ctx, s.key, data)
+	if err != nil {
+		return 0, fmt.Errorf("put config %s: %w", s.key, err)
+	}
+	return rev, nil
+}
+
+// Close stops reloading the config
+func (s *ConfigStore[T]) Close() error {
+	err := s.watcher.Stop()
+	<-s.done
+	return err
+}
+
+// ErrLockHeld is returned by TryAcquire when another owner holds an unexpired lease
+var ErrLockHeld = errors.New("lock held")
+
+// Locker hands out leases on the keys of a KV bucket. A lease lasts its TTL unless renewed,
+// so the lock of a replica that dies is taken over at most one TTL after others start waiting.
+type Locker struct {
+	kv    jetstream.KeyValue
+	owner string
+	now   func() time.Time // time.Now, except in tests
+
+	mu   sync.Mutex
+	seen map[string]observed // Of the keys held by others
+}
+
+// observed is the revision of a lease and when this replica first saw it. A lease is expired when
+// its revision stayed the same for its TTL: the holder renews it well before. Only the time elapsed
+// on each replica matters, not how their clocks compare to each other or to the server's.
+type observed struct {
+	revision uint64
+	at       time.Time
+}
+
+// lease is the value of a locked key
+type lease struct {
+	Owner string        `json:"owner"`
+	TTL   time.Duration `json:"ttl"`
+}
+
+// NewLocker creates bucket if needed, owner identifies this replica in the leases, e.g. its hostname
+func NewLocker(ctx context.Context, js jetstream.JetStream, bucket, owner string) (*Locker, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: bucket, History: 1})
+	if err != nil {
+		return nil, fmt.Errorf("lock bucket %s: %w", bucket, err)
+	}
+	return &Locker{kv: kv, owner: owner, now: time.Now, seen: map[string]observed{}}, nil
+}
+
+// Lock is a held lease, renewed every third of its TTL until Release
+type Lock struct {
+	kv    jetstream.KeyValue
+	key   string
+	value []byte
+	ttl   time.Duration
+
+	// Of the last renewal and when it was sent, only touched by keepAlive until it is done
+	revision uint64
+	renewed  time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	lost     chan struct{}
+}
+
+// Acquire waits until key is free or its lease expired and takes it, or until ctx is done
+func (l *Locker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	// Wake up as soon as the holder releases the key
+	w, err := l.kv.Watch(ctx, key, jetstream.UpdatesOnly())
+	if err != nil {
+		return nil, fmt.Errorf("acquire %s: %w", key, err)
+	}
+	defer w.Stop()
+	for {
+		lock, wait, err := l.tryAcquire(ctx, key, ttl)
+		if !errors.Is(err, ErrLockHeld) {
+			return lock, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-w.Updates():
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("acquire %s: %w", key, ctx.Err())
+		}
+		timer.Stop()
+	}
+}
+
+// TryAcquire takes key if it is free or its lease expired, or returns ErrLockHeld
+func (l *Locker) TryAcquire(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	lock, _, err := l.tryAcquire(ctx, key, ttl)
+	return lock, err
+}
+
+// tryAcquire also returns how long the current lease has left when the key is held
+func (l *Locker) tryAcquire(ctx context.Context, key string, ttl time.Duration) (*Lock, time.Duration, error) {
+	value, err := json.Marshal(lease{Owner: l.owner, TTL: ttl})
+	if err != nil {
+		return nil, 0, err
+	}
+	// The lease is counted from before the write, so the holder gives it up before others take it
+	sent := time.Now()
+	// Create succeeds if the key was never locked or was released
+	rev, err := l.kv.Create(ctx, key, value)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		var e jetstream.KeyValueEntry
+		e, err = l.kv.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			// Released in between, try again right away
+			return nil, 0, fmt.Errorf("acquire %s: %w", key, ErrLockHeld)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("acquire %s: %w", key, err)
+		}
+		var held lease
+		if err := json.Unmarshal(e.Value(), &held); err != nil {
+			return nil, 0, fmt.Errorf("acquire %s: invalid lease: %w", key, err)
+		}
+		if left := l.expiresIn(key, e.Revision(), held.TTL); left > 0 {
+			return nil, left, fmt.Errorf("acquire %s: %w by %s", key, ErrLockHeld, held.Owner)
+		}
+		// Take over the expired lease, unless someone else just did
+		sent = time.Now()
+		rev, err = l.kv.Update(ctx, key, value, e.Revision())
+		if isWrongRevision(err) {
+			return nil, 0, fmt.Errorf("acquire %s: %w", key, ErrLockHeld)
+		}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("acquire %s: %w", key, err)
+	}
+	l.mu.Lock()
+	delete(l.seen, key)
+	l.mu.Unlock()
+
+	lock := &Lock{
+		kv: l.kv, key: key, value: value, ttl: ttl, revision: rev, renewed: sent,
+		stop: make(chan struct{}), done: make(chan struct{}), lost: make(chan struct{}),
+	}
+	go lock.keepAlive()
+	return lock, 0, nil
+}
+
+// expiresIn returns how long the lease at revision has left, from when this replica first saw it
+func (l *Locker) expiresIn(key string, revision uint64, ttl time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen, ok := l.seen[key]
+	if !ok || seen.revision != revision {
+		seen = observed{revision: revision, at: l.now()}
+		l.seen[key] = seen
+	}
+	return ttl - l.now().Sub(seen.at)
+}
+
+// isWrongRevision reports whether a KV update failed because the key changed since the revision it expected
+func isWrongRevision(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+}
+
+// keepAlive renews the lease until Release. The lock is lost when another owner took the key, or
+// when renewing failed and the lease would expire before the next attempt, as others may then take it.
+func (l *Lock) keepAlive() {
+	defer close(l.done)
+	interval := l.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		sent := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		rev, err := l.kv.Update(ctx, l.key, l.value, l.revision)
+		cancel()
+		if err == nil {
+			l.revision, l.renewed = rev, sent
+		}
+		if isWrongRevision(err) || err != nil && time.Since(l.renewed)+interval >= l.ttl {
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// Lost is closed when the lease could not be renewed and another owner may hold the key.
+// Work guarded by the lock must stop then.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release stops renewing the lease and frees the key, unless the lock was already lost.
+// Releasing again does nothing.
+func (l *Lock) Release(ctx context.Context) error {
+	released := true
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		released = false
+	})
+	if released {
+		return nil
+	}
+	<-l.done
+	select {
+	case <-l.lost:
+		return nil
+	default:
+	}
+	if err := l.kv.Delete(ctx, l.key, jetstream.LastRevision(l.revision)); err != nil && !isWrongRevision(err) {
+		return fmt.Errorf("release %s: %w", l.key, err)
+	}
+	return nil
+}
+
+// RunSingleton runs job on one replica at a time: each replica waits for the lock on key, runs
+// job while holding it and, if the lock is lost, cancels job and competes again. It returns when
+// ctx is done or job returns.
+func RunSingleton(ctx context.Context, l *Locker, key string, ttl time.Duration, job func(ctx context.Context) error) error {
+	for {
+		lock, err := l.Acquire(ctx, key, ttl)
+		if err != nil {
+			return err
+		}
+		jobCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-lock.Lost():
+				cancel()
+			case <-jobCtx.Done():
+			}
+		}()
+		err = job(jobCtx)
+		lost := jobCtx.Err() != nil && ctx.Err() == nil
+		cancel()
+		if lost {
+			continue
+		}
+		// Free the key for the other replicas even when ctx is done
+		releaseCtx, cancelRelease := context.WithTimeout(context.Background(), ttl)
+		relErr := lock.Release(releaseCtx)
+		cancelRelease()
+		return errors.Join(err, relErr)
+	}
+}
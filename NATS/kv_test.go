@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type testConfig struct {
+	Greeting string `json:"greeting"`
+	Workers  int    `json:"workers"`
+}
+
+func newTestJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	js, err := jetstream.New(connectTest(t, runJetStream(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func TestConfigStore(t *testing.T) {
+	ctx := context.Background()
+	js := newTestJetStream(t)
+	open := func() *ConfigStore[testConfig] {
+		t.Helper()
+		s, err := OpenConfigStore[testConfig](ctx, js, "config", "greeter", quietLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	writer, replica := open(), open()
+	if cfg, rev := replica.Get(); cfg != (testConfig{}) || rev != 0 {
+		t.Fatalf("expected the zero config before any put, got %+v at %d", cfg, rev)
+	}
+	changes := make(chan testConfig, 10)
+	replica.OnChange(func(cfg testConfig) { changes <- cfg })
+
+	want := testConfig{Greeting: "hello", Workers: 4}
+	rev, err := writer.Put(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-changes:
+		if got != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the replica to reload the config")
+	}
+	if got, gotRev := replica.Get(); got != want || gotRev != rev {
+		t.Fatalf("expected %+v at %d, got %+v at %d", want, rev, got, gotRev)
+	}
+
+	// Configs that can't be read, and deletes, keep the last good one
+	if _, err := writer.kv.PutString(ctx, "greeter", "{not json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.kv.Delete(ctx, "greeter"); err != nil {
+		t.Fatal(err)
+	}
+	next := testConfig{Greeting: "hi", Workers: 8}
+	if _, err := writer.Put(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-changes:
+		if got != next {
+			t.Fatalf("expected %+v after the invalid config, got %+v", next, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the replica to reload the config")
+	}
+
+	// A replica starting now loads the current config
+	if got, _ := open().Get(); got != next {
+		t.Fatalf("expected %+v on open, got %+v", next, got)
+	}
+}
+
+func newTestLocker(t *testing.T, js jetstream.JetStream, owner string) *Locker {
+	t.Helper()
+	l, err := NewLocker(context.Background(), js, "locks", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLocker(t *testing.T) {
+	ctx := context.Background()
+	js := newTestJetStream(t)
+	a, b := newTestLocker(t, js, "a"), newTestLocker(t, js, "b")
+	const ttl = 300 * time.Millisecond
+
+	lock, err := a.Acquire(ctx, "job", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renewed past its TTL
+	time.Sleep(3 * ttl)
+	if _, err := b.TryAcquire(ctx, "job", ttl); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, ttl)
+	defer cancel()
+	if _, err := b.Acquire(waitCtx, "job", ttl); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait until the deadline, got %v", err)
+	}
+
+	// Waiters get the lock as soon as it is released
+	acquired := make(chan *Lock)
+	go func() {
+		lock, err := b.Acquire(ctx, "job", ttl)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- lock
+	}()
+	time.Sleep(50 * time.Millisecond)
+	released := time.Now()
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lockB := <-acquired
+	if lockB == nil {
+		t.FailNow()
+	}
+	defer lockB.Release(ctx)
+	if waited := time.Since(released); waited >= ttl {
+		t.Fatalf("expected the lock right after the release, got it after %v", waited)
+	}
+
+	// Releasing again neither panics nor frees the key of the new owner
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.TryAcquire(ctx, "job", ttl); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+}
+
+func TestLockExpires(t *testing.T) {
+	ctx := context.Background()
+	js := newTestJetStream(t)
+	a, b := newTestLocker(t, js, "a"), newTestLocker(t, js, "b")
+	const ttl = 300 * time.Millisecond
+
+	lock, err := a.Acquire(ctx, "job", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The holder dies without releasing
+	close(lock.stop)
+	<-lock.done
+	start := time.Now()
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	lockB, err := b.Acquire(waitCtx, "job", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockB.Release(ctx)
+	if waited := time.Since(start); waited < ttl {
+		t.Fatalf("expected to wait for the lease to expire, got the lock after %v", waited)
+	}
+}
+
+func TestLockIgnoresClockSkew(t *testing.T) {
+	ctx := context.Background()
+	js := newTestJetStream(t)
+	a, b := newTestLocker(t, js, "a"), newTestLocker(t, js, "b")
+	// Far ahead of the server, b would see every lease as expired if it compared timestamps
+	b.now = func() time.Time { return time.Now().Add(time.Hour) }
+	const ttl = 300 * time.Millisecond
+
+	lock, err := a.Acquire(ctx, "job", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(ctx)
+	// The holder keeps renewing, so the lease never stays at one revision for a TTL
+	deadline := time.Now().Add(3 * ttl)
+	for time.Now().Before(deadline) {
+		if _, err := b.TryAcquire(ctx, "job", ttl); !errors.Is(err, ErrLockHeld) {
+			t.Fatalf("expected the live lease to be held, got %v", err)
+		}
+		time.Sleep(ttl / 10)
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	ctx := context.Background()
+	js := newTestJetStream(t)
+	a := newTestLocker(t, js, "a")
+	const ttl = 300 * time.Millisecond
+
+	lock, err := a.Acquire(ctx, "job", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another owner took the key, e.g. after this one was partitioned for longer than the TTL
+	if _, err := a.kv.PutString(ctx, "job", `{"owner":"b","ttl":300000000}`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lock.Lost():
+	case <-time.After(2 * ttl):
+		t.Fatal("expected the lock to be lost")
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.TryAcquire(ctx, "job", ttl); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected the new owner to keep the key, got %v", err)
+	}
+}
+
+func TestRunSingleton(t *testing.T) {
+	js := newTestJetStream(t)
+	var mu sync.Mutex
+	running, maxRunning, runs := 0, 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		l := newTestLocker(t, js, fmt.Sprint("replica-", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := RunSingleton(ctx, l, "report", time.Second, func(ctx context.Context) error {
+				mu.Lock()
+				running++
+				runs++
+				maxRunning = max(maxRunning, running)
+				mu.Unlock()
+				time.Sleep(100 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if runs != 3 || maxRunning != 1 {
+		t.Fatalf("expected 3 runs one at a time, got %d runs with up to %d at once", runs, maxRunning)
+	}
+}
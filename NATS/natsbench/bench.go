@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Config describes a benchmark run, zero fields take the defaults below
+type Config struct {
+	Subject     string
+	Publishers  int
+	Subscribers int // Each subscriber receives every message
+	Msgs        int // Messages sent by each publisher
+	Size        int // Payload bytes, at least the 8 of the send timestamp
+	// Messages per second sent by each publisher, 0 for as fast as possible. When set, latency
+	// is measured from when each message was due, so a stalled publisher doesn't hide the delay.
+	Rate      int
+	JetStream bool          // Publish to a memory stream and consume with ordered consumers
+	Timeout   time.Duration // For the subscribers to receive everything once publishing is done
+	// Every publisher and subscriber has its own connection, as separate clients would, unless set
+	SharedConn bool
+}
+
+// Dialer opens a connection to the server
+type Dialer func() (*nats.Conn, error)
+
+// Benchmark defaults
+const (
+	defaultSubject = "bench"
+	defaultMsgs    = 100_000
+	defaultSize    = 128
+	defaultTimeout = 10 * time.Second
+	benchStream    = "BENCH"
+	// Latencies are recorded in microseconds, from 1µs to a minute with 3 significant digits
+	maxLatency = int64(time.Minute / time.Microsecond)
+)
+
+func (c *Config) defaults() error {
+	if c.Subject == "" {
+		c.Subject = defaultSubject
+	}
+	if c.Publishers <= 0 {
+		c.Publishers = 1
+	}
+	if c.Subscribers < 0 {
+		return errors.New("subscribers must not be negative")
+	}
+	if c.Msgs <= 0 {
+		c.Msgs = defaultMsgs
+	}
+	if c.Size == 0 {
+		c.Size = defaultSize
+	}
+	if c.Size < 8 {
+		return fmt.Errorf("size must be at least 8 bytes, got %d", c.Size)
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("rate must not be negative, got %d", c.Rate)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	return nil
+}
+
+// Report holds the results of a run
+type Report struct {
+	Config    Config     `json:"config"`
+	Publish   Throughput `json:"publish"`
+	Subscribe Throughput `json:"subscribe"`
+	Latency   Latency    `json:"latency"`
+}
+
+// Throughput of all the publishers or all the subscribers together
+type Throughput struct {
+	Msgs        int64         `json:"msgs"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration_ns"`
+	MsgsPerSec  float64       `json:"msgs_per_sec"`
+	BytesPerSec float64       `json:"bytes_per_sec"`
+}
+
+func throughput(msgs int64, size int, d time.Duration) Throughput {
+	t := Throughput{Msgs: msgs, Bytes: msgs * int64(size), Duration: d}
+	if d > 0 {
+		t.MsgsPerSec = float64(msgs) / d.Seconds()
+		t.BytesPerSec = float64(t.Bytes) / d.Seconds()
+	}
+	return t
+}
+
+// Latency from publish to receipt, over every message received by every subscriber
+type Latency struct {
+	Count int64         `json:"count"`
+	Min   time.Duration `json:"min_ns"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	P999  time.Duration `json:"p999_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func latency(h *hdrhistogram.Histogram) Latency {
+	us := func(v int64) time.Duration { return time.Duration(v) * time.Microsecond }
+	return Latency{
+		Count: h.TotalCount(),
+		Min:   us(h.Min()),
+		Mean:  time.Duration(h.Mean() * float64(time.Microsecond)),
+		P50:   us(h.ValueAtQuantile(50)),
+		P99:   us(h.ValueAtQuantile(99)),
+		P999:  us(h.ValueAtQuantile(99.9)),
+		Max:   us(h.Max()),
+	}
+}
+
+// subscriber counts the messages of one subscription and records their latency
+type subscriber struct {
+	hist     *hdrhistogram.Histogram
+	expected int64
+	received atomic.Int64
+	mu       sync.Mutex // Guards hist and last
+	last     time.Time
+	done     chan struct{}
+}
+
+func newSubscriber(expected int64) *subscriber {
+	return &subscriber{hist: hdrhistogram.New(1, maxLatency, 3), expected: expected, done: make(chan struct{})}
+}
+
+func (s *subscriber) record(data []byte) {
+	now := time.Now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	s.mu.Lock()
+	s.last = now
+	// Values out of range, e.g. from clock steps, are clamped rather than lost
+	s.hist.RecordValue(min(max(now.Sub(sent).Microseconds(), 1), maxLatency))
+	s.mu.Unlock()
+	if s.received.Add(1) == s.expected {
+		close(s.done)
+	}
+}
+
+// client is the connection of a publisher or subscriber, js is nil unless cfg.JetStream
+type client struct {
+	nc *nats.Conn
+	js jetstream.JetStream
+}
+
+// Run runs the benchmark described by cfg, on connections opened with dial
+func Run(ctx context.Context, dial Dialer, cfg Config) (*Report, error) {
+	if err := cfg.defaults(); err != nil {
+		return nil, err
+	}
+	expected := int64(cfg.Publishers * cfg.Msgs)
+
+	// Cleanups, run last to first
+	var stop []func()
+	defer func() {
+		for i := len(stop) - 1; i >= 0; i-- {
+			stop[i]()
+		}
+	}()
+	var shared *client
+	connect := func() (*client, error) {
+		if shared != nil {
+			return shared, nil
+		}
+		nc, err := dial()
+		if err != nil {
+			return nil, fmt.Errorf("connect: %w", err)
+		}
+		stop = append(stop, nc.Close)
+		c := &client{nc: nc}
+		if cfg.JetStream {
+			if c.js, err = jetstream.New(nc); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.SharedConn {
+			shared = c
+		}
+		return c, nil
+	}
+
+	// The stream is set up on a connection of its own, which deletes it once the clients are done
+	admin, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]*subscriber, cfg.Subscribers)
+	if cfg.JetStream {
+		js := admin.js
+		// A fresh stream each run, so the consumers only see this run's messages
+		if err := js.DeleteStream(ctx, benchStream); err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
+			return nil, fmt.Errorf("delete stream: %w", err)
+		}
+		if _, err := js.CreateStream(ctx, jetstream.StreamConfig{
+			Name: benchStream, Subjects: []string{cfg.Subject}, Storage: jetstream.MemoryStorage,
+		}); err != nil {
+			return nil, fmt.Errorf("create stream: %w", err)
+		}
+		stop = append(stop, func() { js.DeleteStream(context.Background(), benchStream) })
+		for i := range subs {
+			c, err := connect()
+			if err != nil {
+				return nil, err
+			}
+			s := newSubscriber(expected)
+			cons, err := c.js.OrderedConsumer(ctx, benchStream, jetstream.OrderedConsumerConfig{})
+			if err != nil {
+				return nil, fmt.Errorf("consumer: %w", err)
+			}
+			cc, err := cons.Consume(func(msg jetstream.Msg) { s.record(msg.Data()) })
+			if err != nil {
+				return nil, fmt.Errorf("consume: %w", err)
+			}
+			subs[i], stop = s, append(stop, cc.Stop)
+		}
+	} else {
+		for i := range subs {
+			c, err := connect()
+			if err != nil {
+				return nil, err
+			}
+			s := newSubscriber(expected)
+			sub, err := c.nc.Subscribe(cfg.Subject, func(msg *nats.Msg) { s.record(msg.Data) })
+			if err != nil {
+				return nil, fmt.Errorf("subscribe: %w", err)
+			}
+			// Count slow consumers' drops as missing messages instead of disconnecting
+			if err := sub.SetPendingLimits(-1, -1); err != nil {
+				return nil, err
+			}
+			subs[i], stop = s, append(stop, func() { sub.Unsubscribe() })
+			// The subscription must reach the server before the first publish
+			if err := c.nc.FlushTimeout(cfg.Timeout); err != nil {
+				return nil, fmt.Errorf("flush: %w", err)
+			}
+		}
+	}
+
+	// Connected before the clock starts
+	pubs := make([]*client, cfg.Publishers)
+	for i := range pubs {
+		if pubs[i], err = connect(); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, cfg.Publishers)
+	for _, c := range pubs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := publish(ctx, c, cfg); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := errors.Join(drainErrors(errs)...); err != nil {
+		return nil, err
+	}
+	pubDuration := time.Since(start)
+
+	// Wait for every subscriber, those that time out report what they got
+	waitCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	for _, s := range subs {
+		select {
+		case <-s.done:
+		case <-waitCtx.Done():
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{Config: cfg, Publish: throughput(expected, cfg.Size, pubDuration)}
+	hist := hdrhistogram.New(1, maxLatency, 3)
+	var received int64
+	var last time.Time
+	for _, s := range subs {
+		s.mu.Lock()
+		hist.Merge(s.hist)
+		if s.last.After(last) {
+			last = s.last
+		}
+		s.mu.Unlock()
+		received += s.received.Load()
+	}
+	if received > 0 {
+		report.Subscribe = throughput(received, cfg.Size, last.Sub(start))
+	}
+	report.Latency = latency(hist)
+	return report, nil
+}
+
+func drainErrors(errs <-chan error) []error {
+	var out []error
+	for err := range errs {
+		out = append(out, err)
+	}
+	return out
+}
+
+// publish sends cfg.Msgs messages, at cfg.Rate per second if set, each starting with the
+// Unix nanoseconds it was sent, or due, at
+func publish(ctx context.Context, c *client, cfg Config) error {
+	var interval time.Duration
+	if cfg.Rate > 0 {
+		interval = time.Second / time.Duration(cfg.Rate)
+	}
+	start := time.Now()
+	for i := 0; i < cfg.Msgs; i++ {
+		sent := time.Now()
+		if interval > 0 {
+			due := start.Add(time.Duration(i) * interval)
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+			sent = due
+		}
+		// Each message gets its own buffer, the client may still hold the previous one
+		data := make([]byte, cfg.Size)
+		binary.BigEndian.PutUint64(data, uint64(sent.UnixNano()))
+		if c.js != nil {
+			if _, err := c.js.PublishAsync(cfg.Subject, data); err != nil {
+				return fmt.Errorf("publish: %w", err)
+			}
+		} else if err := c.nc.Publish(cfg.Subject, data); err != nil {
+			return fmt.Errorf("publish: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if c.js != nil {
+		select {
+		case <-c.js.PublishAsyncComplete():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	}
+	return c.nc.FlushTimeout(cfg.Timeout)
+}
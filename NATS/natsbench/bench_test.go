@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// startServer starts an embedded NATS server with JetStream and returns a dialer counting its connections
+func startServer(t *testing.T) (Dialer, *atomic.Int64) {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("embedded NATS server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	var dials atomic.Int64
+	return func() (*nats.Conn, error) {
+		dials.Add(1)
+		return nats.Connect(s.ClientURL())
+	}, &dials
+}
+
+func TestRun(t *testing.T) {
+	dial, dials := startServer(t)
+	for _, tc := range []struct {
+		name        string
+		cfg         Config
+		minDuration time.Duration
+	}{
+		{"core", Config{Publishers: 2, Subscribers: 3, Msgs: 1000, Size: 64}, 0},
+		{"jetstream", Config{Publishers: 2, Subscribers: 2, Msgs: 500, JetStream: true}, 0},
+		{"no subscribers", Config{Publishers: 1, Msgs: 100}, 0},
+		{"rate limited", Config{Publishers: 1, Subscribers: 1, Msgs: 50, Rate: 500}, 90 * time.Millisecond},
+		{"shared connection", Config{Publishers: 2, Subscribers: 2, Msgs: 500, SharedConn: true}, 0},
+		{"shared jetstream connection", Config{Publishers: 2, Subscribers: 2, Msgs: 500, JetStream: true, SharedConn: true}, 0},
+	} {
+		dials.Store(0)
+		r, err := Run(context.Background(), dial, tc.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// One connection per client and one setting up, or a single one
+		conns := int64(tc.cfg.Publishers + tc.cfg.Subscribers + 1)
+		if tc.cfg.SharedConn {
+			conns = 1
+		}
+		if got := dials.Load(); got != conns {
+			t.Fatalf("%s: expected %d connections, got %d", tc.name, conns, got)
+		}
+		sent := int64(tc.cfg.Publishers * tc.cfg.Msgs)
+		if r.Publish.Msgs != sent {
+			t.Fatalf("%s: expected %d msgs published, got %d", tc.name, sent, r.Publish.Msgs)
+		}
+		if want := sent * int64(tc.cfg.Subscribers); r.Subscribe.Msgs != want || r.Latency.Count != want {
+			t.Fatalf("%s: expected %d msgs received, got %d with %d latencies", tc.name, want, r.Subscribe.Msgs, r.Latency.Count)
+		}
+		if r.Publish.Duration < tc.minDuration {
+			t.Fatalf("%s: expected publishing to take at least %v, got %v", tc.name, tc.minDuration, r.Publish.Duration)
+		}
+		l := r.Latency
+		if !(l.Min <= l.P50 && l.P50 <= l.P99 && l.P99 <= l.P999 && l.P999 <= l.Max) {
+			t.Fatalf("%s: expected ordered percentiles, got %+v", tc.name, l)
+		}
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	dial, _ := startServer(t)
+	for _, cfg := range []Config{{Size: 4}, {Rate: -1}, {Subscribers: -1}} {
+		if _, err := Run(context.Background(), dial, cfg); err == nil {
+			t.Fatalf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	r := &Report{
+		Config:    Config{Subject: "bench", Publishers: 1, Subscribers: 1, Msgs: 10, Size: 8, Timeout: time.Second},
+		Publish:   throughput(10, 8, time.Second),
+		Subscribe: throughput(9, 8, time.Second),
+		Latency:   Latency{Count: 9, P50: time.Millisecond},
+	}
+
+	var text bytes.Buffer
+	if err := writeText(&text, r); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"core on bench", "pub: 10 msgs", "10 msgs/s", "missing: 1 msgs", "p50 1ms"} {
+		if !strings.Contains(text.String(), want) {
+			t.Fatalf("expected %q in the report, got\n%s", want, text.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != *r {
+		t.Fatalf("expected %+v, got %+v", *r, decoded)
+	}
+}
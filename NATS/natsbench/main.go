@@ -0,0 +1,96 @@
+// natsbench measures the throughput and end-to-end latency of NATS pub/sub:
+//
+//	go run ./NATS/natsbench -pubs 4 -subs 2 -msgs 100000 -size 256 -rate 5000 [-js] [-shared-conn] [-json]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+	var cfg Config
+	url := flag.String("url", nats.DefaultURL, "NATS server URL")
+	flag.StringVar(&cfg.Subject, "subject", defaultSubject, "subject to publish to")
+	flag.IntVar(&cfg.Publishers, "pubs", 1, "publishers")
+	flag.IntVar(&cfg.Subscribers, "subs", 1, "subscribers, each receives every message")
+	flag.IntVar(&cfg.Msgs, "msgs", defaultMsgs, "messages per publisher")
+	flag.IntVar(&cfg.Size, "size", defaultSize, "message size in bytes, at least 8")
+	flag.IntVar(&cfg.Rate, "rate", 0, "messages per second per publisher, 0 for as fast as possible")
+	flag.BoolVar(&cfg.JetStream, "js", false, "publish to a memory stream and consume with ordered consumers")
+	flag.BoolVar(&cfg.SharedConn, "shared-conn", false, "use one connection for every publisher and subscriber instead of one each")
+	flag.DurationVar(&cfg.Timeout, "timeout", defaultTimeout, "wait for the subscribers once publishing is done")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	dial := func() (*nats.Conn, error) { return nats.Connect(*url, nats.Name("natsbench")) }
+	report, err := Run(ctx, dial, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		err = writeJSON(os.Stdout, report)
+	} else {
+		err = writeText(os.Stdout, report)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeJSON(w io.Writer, r *Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func writeText(w io.Writer, r *Report) error {
+	mode := "core"
+	if r.Config.JetStream {
+		mode = "jetstream"
+	}
+	if r.Config.SharedConn {
+		mode += " (shared connection)"
+	}
+	rate := "max"
+	if r.Config.Rate > 0 {
+		rate = fmt.Sprintf("%d/s", r.Config.Rate)
+	}
+	fmt.Fprintf(w, "%s on %s: %d publishers x %d msgs of %d B at %s, %d subscribers\n",
+		mode, r.Config.Subject, r.Config.Publishers, r.Config.Msgs, r.Config.Size, rate, r.Config.Subscribers)
+	for _, t := range []struct {
+		name string
+		Throughput
+	}{{"pub", r.Publish}, {"sub", r.Subscribe}} {
+		fmt.Fprintf(w, "%s: %d msgs in %v, %.0f msgs/s, %s/s\n",
+			t.name, t.Msgs, t.Duration.Round(time.Millisecond), t.MsgsPerSec, bytesSize(t.BytesPerSec))
+	}
+	if missing := int64(r.Config.Publishers*r.Config.Msgs*r.Config.Subscribers) - r.Subscribe.Msgs; missing > 0 {
+		fmt.Fprintf(w, "missing: %d msgs not received within %v\n", missing, r.Config.Timeout)
+	}
+	l := r.Latency
+	_, err := fmt.Fprintf(w, "latency: min %v, mean %v, p50 %v, p99 %v, p99.9 %v, max %v\n",
+		l.Min, l.Mean, l.P50, l.P99, l.P999, l.Max)
+	return err
+}
+
+// bytesSize formats n bytes with a binary unit
+func bytesSize(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
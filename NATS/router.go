@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// RouteMsg is a message delivered to a route, with the tokens captured by its pattern
+type RouteMsg struct {
+	*nats.Msg
+	Pattern string            // The route's pattern, e.g. greet.{name}
+	Params  map[string]string // Captured tokens by name, the tail matched by > under ">"
+}
+
+// RouteHandler handles a routed message. If it fails and the message has a reply subject,
+// the error is sent back as an error reply (see RPCError).
+type RouteHandler func(ctx context.Context, msg *RouteMsg) error
+
+// Middleware wraps a handler, e.g. to log, authorize or recover
+type Middleware func(next RouteHandler) RouteHandler
+
+// Router dispatches the messages of NATS subjects to handlers by pattern. Patterns are subjects
+// whose tokens may be {name} (any one token, captured), * (any one token) or, as the last
+// token, > (the rest of the subject, captured as ">"). Each pattern is one subscription.
+type Router struct {
+	nc         *nats.Conn
+	queue      string
+	mu         sync.Mutex
+	middleware []Middleware
+	subs       map[string]*nats.Subscription // By subject
+}
+
+// NewRouter returns a router subscribing on nc, in queue group queue unless it is empty
+func NewRouter(nc *nats.Conn, queue string) *Router {
+	return &Router{nc: nc, queue: queue, subs: make(map[string]*nats.Subscription)}
+}
+
+// Use adds middleware run by the routes registered afterwards, in the order added
+func (r *Router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// ErrDuplicateRoute is returned when two patterns subscribe to the same subject, e.g. greet.{name} and greet.*
+var ErrDuplicateRoute = errors.New("route already registered")
+
+// Handle subscribes to pattern, running handler behind the router's middleware and then mw
+func (r *Router) Handle(pattern string, handler RouteHandler, mw ...Middleware) error {
+	subject, names, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subs[subject]; ok {
+		return fmt.Errorf("route %s: %w", pattern, ErrDuplicateRoute)
+	}
+	chain := append(append([]Middleware{}, r.middleware...), mw...)
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+
+	sub, err := r.nc.QueueSubscribe(subject, r.queue, func(msg *nats.Msg) {
+		ctx, cancel := requestContext(msg)
+		defer cancel()
+		rm := &RouteMsg{Msg: msg, Pattern: pattern, Params: params(names, msg.Subject)}
+		if err := handler(ctx, rm); err != nil && msg.Reply != "" {
+			// The requester is gone if this fails
+			_ = msg.RespondMsg(errorReply(err))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("route %s: %w", pattern, err)
+	}
+	r.subs[subject] = sub
+	return nil
+}
+
+// Drain stops receiving, lets the handlers finish the messages already received and waits for them
+func (r *Router) Drain(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var closed []<-chan nats.SubStatus
+	for subject, sub := range r.subs {
+		closed = append(closed, sub.StatusChanged(nats.SubscriptionClosed))
+		if err := sub.Drain(); err != nil {
+			return fmt.Errorf("drain %s: %w", subject, err)
+		}
+		delete(r.subs, subject)
+	}
+	for _, c := range closed {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			return fmt.Errorf("drain: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// parsePattern returns the subject to subscribe to for pattern, and the name captured by each
+// of its tokens ("" if the token is not captured)
+func parsePattern(pattern string) (string, []string, error) {
+	tokens := strings.Split(pattern, ".")
+	names := make([]string, len(tokens))
+	seen := map[string]bool{}
+	for i, tok := range tokens {
+		switch {
+		case tok == "":
+			return "", nil, fmt.Errorf("route %s: empty token", pattern)
+		case tok == "*":
+		case tok == ">":
+			if i != len(tokens)-1 {
+				return "", nil, fmt.Errorf("route %s: > must be the last token", pattern)
+			}
+			names[i] = ">"
+		case strings.HasPrefix(tok, "{") && strings.HasSuffix(tok, "}"):
+			name := tok[1 : len(tok)-1]
+			if name == "" || seen[name] {
+				return "", nil, fmt.Errorf("route %s: invalid or repeated parameter %q", pattern, name)
+			}
+			seen[name] = true
+			names[i] = name
+			tokens[i] = "*"
+		case strings.ContainsAny(tok, "{}*> \t"):
+			return "", nil, fmt.Errorf("route %s: invalid token %q", pattern, tok)
+		}
+	}
+	return strings.Join(tokens, "."), names, nil
+}
+
+// params extracts the captured tokens of subject, which matched the pattern names were parsed from
+func params(names []string, subject string) map[string]string {
+	tokens := strings.Split(subject, ".")
+	p := make(map[string]string)
+	for i, name := range names {
+		switch {
+		case name == ">":
+			p[name] = strings.Join(tokens[i:], ".")
+		case name != "":
+			p[name] = tokens[i]
+		}
+	}
+	return p
+}
+
+// Logging logs every message with its outcome and duration
+func Logging(logger *slog.Logger) Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(ctx context.Context, msg *RouteMsg) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			attrs := []any{"subject", msg.Subject, "pattern", msg.Pattern, "duration", time.Since(start)}
+			if err != nil {
+				logger.Error("nats message", append(attrs, "error", err)...)
+			} else {
+				logger.Info("nats message", attrs...)
+			}
+			return err
+		}
+	}
+}
+
+// Recovery turns a panicking handler into an error with CodePanic
+func Recovery() Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(ctx context.Context, msg *RouteMsg) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = NewRPCError(CodePanic, fmt.Sprint(r))
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// CodeUnauthorized is the error code of messages rejected by RequireHeader
+const CodeUnauthorized = "unauthorized"
+
+// RequireHeader rejects messages whose header is missing or not accepted by valid, e.g. to check a token
+func RequireHeader(header string, valid func(value string) bool) Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(ctx context.Context, msg *RouteMsg) error {
+			if v := msg.Header.Get(header); v == "" || !valid(v) {
+				return NewRPCError(CodeUnauthorized, "missing or invalid "+header)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// RouteStats are the counters of one pattern
+type RouteStats struct {
+	Handled  int
+	Failed   int
+	Duration time.Duration // Total time spent in the handler
+}
+
+// RouteMetrics counts messages and handling time per pattern
+type RouteMetrics struct {
+	mu    sync.Mutex
+	stats map[string]RouteStats
+}
+
+func NewRouteMetrics() *RouteMetrics {
+	return &RouteMetrics{stats: make(map[string]RouteStats)}
+}
+
+// Middleware records the messages handled by the routes it wraps
+func (m *RouteMetrics) Middleware(next RouteHandler) RouteHandler {
+	return func(ctx context.Context, msg *RouteMsg) error {
+		start := time.Now()
+		err := next(ctx, msg)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		s := m.stats[msg.Pattern]
+		s.Handled++
+		if err != nil {
+			s.Failed++
+		}
+		s.Duration += time.Since(start)
+		m.stats[msg.Pattern] = s
+		return err
+	}
+}
+
+// Snapshot returns a copy of the counters by pattern
+func (m *RouteMetrics) Snapshot() map[string]RouteStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]RouteStats, len(m.stats))
+	for k, v := range m.stats {
+		out[k] = v
+	}
+	return out
+}
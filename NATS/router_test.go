@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestParsePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		subject string
+		names   []string
+		err     bool
+	}{
+		{"greet.{name}", "greet.*", []string{"", "name"}, false},
+		{"orders.>", "orders.>", []string{"", ">"}, false},
+		{"orders.{id}.items.>", "orders.*.items.>", []string{"", "id", "", ">"}, false},
+		{"greet.*", "greet.*", []string{"", ""}, false},
+		{"greet..x", "", nil, true},
+		{"orders.>.x", "", nil, true},
+		{"greet.{}", "", nil, true},
+		{"a.{x}.{x}", "", nil, true},
+		{"greet.jo*", "", nil, true},
+	} {
+		subject, names, err := parsePattern(tc.pattern)
+		if (err != nil) != tc.err {
+			t.Fatalf("%s: expected error %v, got %v", tc.pattern, tc.err, err)
+		}
+		if subject != tc.subject || !reflect.DeepEqual(names, tc.names) && !tc.err {
+			t.Fatalf("%s: expected %s %q, got %s %q", tc.pattern, tc.subject, tc.names, subject, names)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	s := runServer(t)
+	nc, client := connectTest(t, s), connectTest(t, s)
+	r := NewRouter(nc, "")
+	metrics := NewRouteMetrics()
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next RouteHandler) RouteHandler {
+			return func(ctx context.Context, msg *RouteMsg) error {
+				order = append(order, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	r.Use(metrics.Middleware, Recovery(), trace("router"))
+
+	if err := r.Handle("greet.{name}", func(ctx context.Context, msg *RouteMsg) error {
+		if msg.Params["name"] == "panic" {
+			panic("boom")
+		}
+		return msg.Respond([]byte("hello " + msg.Params["name"]))
+	}, trace("route")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Handle("orders.{id}.>", func(ctx context.Context, msg *RouteMsg) error {
+		return msg.Respond([]byte(msg.Params["id"] + " " + msg.Params[">"]))
+	}, RequireHeader("Authorization", func(token string) bool { return token == "secret" })); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Handle("greet.*", nil); !errors.Is(err, ErrDuplicateRoute) {
+		t.Fatalf("expected ErrDuplicateRoute, got %v", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(subject, token string) *nats.Msg {
+		t.Helper()
+		msg := nats.NewMsg(subject)
+		if token != "" {
+			msg.Header.Set("Authorization", token)
+		}
+		reply, err := client.RequestMsg(msg, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	if reply := request("greet.joe", ""); string(reply.Data) != "hello joe" {
+		t.Fatalf("expected %q, got %q", "hello joe", reply.Data)
+	}
+	if !reflect.DeepEqual(order, []string{"router", "route"}) {
+		t.Fatalf("expected router then route middleware, got %v", order)
+	}
+	if reply := request("greet.panic", ""); reply.Header.Get(headerErrorCode) != CodePanic {
+		t.Fatalf("expected a panic error reply, got %v", reply.Header)
+	}
+	if reply := request("orders.42.items.7", "secret"); string(reply.Data) != "42 items.7" {
+		t.Fatalf("expected %q, got %q", "42 items.7", reply.Data)
+	}
+	if reply := request("orders.42.items.7", "wrong"); reply.Header.Get(headerErrorCode) != CodeUnauthorized {
+		t.Fatalf("expected an unauthorized error reply, got %v", reply.Header)
+	}
+
+	stats := metrics.Snapshot()
+	if got := stats["greet.{name}"]; got.Handled != 2 || got.Failed != 1 {
+		t.Fatalf("expected 2 greet messages with 1 failure, got %+v", got)
+	}
+	if got := stats["orders.{id}.>"]; got.Handled != 2 || got.Failed != 1 {
+		t.Fatalf("expected 2 order messages with 1 failure, got %+v", got)
+	}
+
+	if err := r.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Request("greet.joe", nil, time.Second); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected no responders after draining, got %v", err)
+	}
+}
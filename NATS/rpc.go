@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Headers of RPC requests and replies
+const (
+	headerDeadline  = "Rpc-Deadline"   // Caller's deadline in Unix nanoseconds, becomes the handler's
+	headerErrorCode = "Rpc-Error-Code" // Set on error replies, which have no body
+	headerError     = "Rpc-Error"
+)
+
+// Error codes set by the RPC layer itself, handlers choose their own with NewRPCError
+const (
+	CodeBadRequest = "bad_request" // The request could not be decoded
+	CodeInternal   = "internal"    // The handler returned a plain error
+)
+
+// Queue group of RPC handlers, replicas registering the same subject share the requests
+const rpcQueue = "rpc"
+
+// Timeout of a Call whose context has no deadline
+const defaultRPCTimeout = 5 * time.Second
+
+// RPCError is an error reply, returned by Call and by handlers that want to choose the code
+type RPCError struct {
+	Code    string
+	Message string
+}
+
+func NewRPCError(code, message string) *RPCError {
+	return &RPCError{Code: code, Message: message}
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc %s: %s", e.Code, e.Message)
+}
+
+// Handler serves one RPC, ctx is canceled when the caller's deadline passes
+type Handler[Req, Resp any] func(ctx context.Context, req Req) (Resp, error)
+
+// Register serves subject with handler. Requests are decoded by their Content-Type, JSON if they
+// have none, replies encoded as the caller asks (see Codec.Respond) and errors sent back in
+// headers, see RPCError.
+func Register[Req, Resp any](nc *nats.Conn, subject string, handler Handler[Req, Resp]) (*nats.Subscription, error) {
+	return nc.QueueSubscribe(subject, rpcQueue, func(msg *nats.Msg) {
+		ctx, cancel := requestContext(msg)
+		defer cancel()
+
+		var reply *nats.Msg
+		var req Req
+		if err := Decode(msg.Header, msg.Data, &req); err != nil {
+			reply = errorReply(NewRPCError(CodeBadRequest, err.Error()))
+		} else if resp, err := handler(ctx, req); err != nil {
+			reply = errorReply(err)
+		} else {
+			reply = nats.NewMsg("")
+			if err := DefaultCodec.encodeWith(DefaultCodec.replyEncoder(msg.Header), reply, resp); err != nil {
+				reply = errorReply(err)
+			}
+		}
+		// The caller is gone if this fails, there is no one to tell
+		_ = msg.RespondMsg(reply)
+	})
+}
+
+// Call sends req as JSON to the handler registered on subject and decodes its reply.
+// Error replies are returned as *RPCError, a missing handler as nats.ErrNoResponders.
+func Call[Req, Resp any](ctx context.Context, nc *nats.Conn, subject string, req Req) (Resp, error) {
+	return CallWith[Req, Resp](ctx, nc, DefaultCodec, subject, req)
+}
+
+// CallWith is Call encoding the request, and asking for the reply, with codec
+func CallWith[Req, Resp any](ctx context.Context, nc *nats.Conn, codec Codec, subject string, req Req) (Resp, error) {
+	var resp Resp
+	msg := nats.NewMsg(subject)
+	if err := codec.Encode(msg, req); err != nil {
+		return resp, fmt.Errorf("call %s: %w", subject, err)
+	}
+	msg.Header.Set(headerAccept, codec.encoder().ContentType())
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRPCTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	msg.Header.Set(headerDeadline, strconv.FormatInt(deadline.UnixNano(), 10))
+	InjectTrace(ctx, msg)
+	reply, err := nc.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return resp, fmt.Errorf("call %s: %w", subject, err)
+	}
+	if code := reply.Header.Get(headerErrorCode); code != "" {
+		return resp, NewRPCError(code, reply.Header.Get(headerError))
+	}
+	if err := Decode(reply.Header, reply.Data, &resp); err != nil {
+		return resp, fmt.Errorf("call %s: decode reply: %w", subject, err)
+	}
+	return resp, nil
+}
+
+// requestContext returns a context ending at the caller's deadline, if it sent one,
+// and carrying the caller's span context, if it sent one
+func requestContext(msg *nats.Msg) (context.Context, context.CancelFunc) {
+	ctx := ExtractTrace(context.Background(), msg.Header)
+	if ns, err := strconv.ParseInt(msg.Header.Get(headerDeadline), 10, 64); err == nil {
+		return context.WithDeadline(ctx, time.Unix(0, ns))
+	}
+	return context.WithCancel(ctx)
+}
+
+func errorReply(err error) *nats.Msg {
+	rpcErr := NewRPCError(CodeInternal, err.Error())
+	errors.As(err, &rpcErr)
+	msg := nats.NewMsg("")
+	msg.Header.Set(headerErrorCode, rpcErr.Code)
+	msg.Header.Set(headerError, rpcErr.Message)
+	return msg
+}
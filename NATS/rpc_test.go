@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type greetRequest struct {
+	Name string `json:"name"`
+}
+
+type greetReply struct {
+	Greeting string `json:"greeting"`
+}
+
+func greet(ctx context.Context, req greetRequest) (greetReply, error) {
+	switch req.Name {
+	case "":
+		return greetReply{}, NewRPCError("invalid_name", "name is required")
+	case "fail":
+		return greetReply{}, errors.New("something broke")
+	case "slow":
+		<-ctx.Done()
+		return greetReply{}, ctx.Err()
+	}
+	return greetReply{Greeting: "hello " + req.Name}, nil
+}
+
+func TestRPC(t *testing.T) {
+	s := runServer(t)
+	server, client := connectTest(t, s), connectTest(t, s)
+	if _, err := Register(server, "rpc.greet", greet); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	resp, err := Call[greetRequest, greetReply](ctx, client, "rpc.greet", greetRequest{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Greeting != "hello joe" {
+		t.Fatalf("expected %q, got %q", "hello joe", resp.Greeting)
+	}
+
+	for _, tc := range []struct {
+		name string
+		code string
+		msg  string
+	}{
+		{"", "invalid_name", "name is required"},
+		{"fail", CodeInternal, "something broke"},
+	} {
+		_, err := Call[greetRequest, greetReply](ctx, client, "rpc.greet", greetRequest{Name: tc.name})
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != tc.code || rpcErr.Message != tc.msg {
+			t.Fatalf("expected %s error %q, got %v", tc.code, tc.msg, err)
+		}
+	}
+
+	// A request the handler can't decode
+	_, err = Call[string, greetReply](ctx, client, "rpc.greet", "joe")
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeBadRequest {
+		t.Fatalf("expected a bad_request error, got %v", err)
+	}
+
+	// The caller's deadline is passed on to the handler
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = Call[greetRequest, greetReply](ctx, client, "rpc.greet", greetRequest{Name: "slow"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected the call to end at its deadline, took %v", time.Since(start))
+	}
+
+	_, err = Call[greetRequest, greetReply](context.Background(), client, "rpc.nobody", greetRequest{})
+	if !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected nats.ErrNoResponders, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "rpc.nobody") {
+		t.Fatalf("expected the error to name the subject, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer of the NATS helpers
+const tracerName = "go-learn/NATS"
+
+// W3C trace context, carried in the traceparent and tracestate headers of HTTP requests and NATS messages
+var tracePropagator = propagation.TraceContext{}
+
+// headerCarrier reads and writes the trace headers of a NATS message. Unlike HTTP, NATS headers
+// are case sensitive, the keys are kept as the propagator writes them (traceparent, tracestate).
+type headerCarrier nats.Header
+
+func (h headerCarrier) Get(key string) string {
+	return nats.Header(h).Get(key)
+}
+
+func (h headerCarrier) Set(key, value string) {
+	nats.Header(h).Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// InjectTrace writes the span context of ctx to the headers of msg, if ctx has one
+func InjectTrace(ctx context.Context, msg *nats.Msg) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	tracePropagator.Inject(ctx, headerCarrier(msg.Header))
+}
+
+// ExtractTrace returns ctx with the span context sent in header as the remote parent
+func ExtractTrace(ctx context.Context, header nats.Header) context.Context {
+	if header == nil {
+		return ctx
+	}
+	return tracePropagator.Extract(ctx, headerCarrier(header))
+}
+
+// messagingAttrs describes a NATS message on spans
+func messagingAttrs(subject string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("messaging.system", "nats"),
+		attribute.String("messaging.destination.name", subject),
+	)
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartPublish starts a producer span for msg and injects it, publish msg with any API and end the span
+func StartPublish(ctx context.Context, tracer trace.Tracer, msg *nats.Msg) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "publish "+msg.Subject, trace.WithSpanKind(trace.SpanKindProducer), messagingAttrs(msg.Subject))
+	InjectTrace(ctx, msg)
+	return ctx, span
+}
+
+// PublishTraced publishes msg on nc in a producer span, a child of the span of ctx
+func PublishTraced(ctx context.Context, nc *nats.Conn, tracer trace.Tracer, msg *nats.Msg) error {
+	_, span := StartPublish(ctx, tracer, msg)
+	err := nc.PublishMsg(msg)
+	endSpan(span, err)
+	return err
+}
+
+// Tracing runs routes in a consumer span, a child of the span whose context the message carries
+func Tracing(tracer trace.Tracer) Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(ctx context.Context, msg *RouteMsg) error {
+			ctx, span := tracer.Start(ExtractTrace(ctx, msg.Header), "process "+msg.Pattern,
+				trace.WithSpanKind(trace.SpanKindConsumer), messagingAttrs(msg.Subject))
+			err := next(ctx, msg)
+			endSpan(span, err)
+			return err
+		}
+	}
+}
+
+// TraceWork runs a worker pool handler in a consumer span, see Tracing
+func TraceWork(tracer trace.Tracer, handler WorkHandler) WorkHandler {
+	return func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+		ctx, span := tracer.Start(ExtractTrace(ctx, msg.Header), "process "+msg.Sub.Subject,
+			trace.WithSpanKind(trace.SpanKindConsumer), messagingAttrs(msg.Subject))
+		data, err := handler(ctx, msg)
+		endSpan(span, err)
+		return data, err
+	}
+}
+
+// TraceMsg runs a JetStream handler in a consumer span, see Tracing
+func TraceMsg(tracer trace.Tracer, handler MsgHandler) MsgHandler {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		ctx, span := tracer.Start(ExtractTrace(ctx, msg.Headers()), "process "+msg.Subject(),
+			trace.WithSpanKind(trace.SpanKindConsumer), messagingAttrs(msg.Subject()))
+		if md, err := msg.Metadata(); err == nil {
+			span.SetAttributes(
+				attribute.String("messaging.consumer.group.name", md.Consumer),
+				attribute.Int64("messaging.nats.stream.sequence", int64(md.Sequence.Stream)),
+				attribute.Int64("messaging.nats.delivery.count", int64(md.NumDelivered)),
+			)
+		}
+		err := handler(ctx, msg)
+		endSpan(span, err)
+		return err
+	}
+}
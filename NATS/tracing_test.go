@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nats-io/nats.go"
+	"go-learn/fiber/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans returns a tracer whose ended spans are kept by the returned recorder
+func recordSpans(t *testing.T) (trace.Tracer, *tracetest.SpanRecorder) {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return tp.Tracer(tracerName), rec
+}
+
+func TestInjectExtractTrace(t *testing.T) {
+	tracer, _ := recordSpans(t)
+	ctx, span := tracer.Start(context.Background(), "parent")
+	defer span.End()
+
+	for _, tc := range []struct {
+		name   string
+		ctx    context.Context
+		header bool
+	}{
+		{"with span", ctx, true},
+		{"without span", context.Background(), false},
+	} {
+		msg := nats.NewMsg("greet.joe")
+		InjectTrace(tc.ctx, msg)
+		if _, ok := msg.Header["traceparent"]; ok != tc.header {
+			t.Fatalf("%s: expected traceparent header %v, got %v", tc.name, tc.header, msg.Header)
+		}
+		got := trace.SpanContextFromContext(ExtractTrace(context.Background(), msg.Header))
+		if want := trace.SpanContextFromContext(tc.ctx); got.TraceID() != want.TraceID() || got.SpanID() != want.SpanID() {
+			t.Fatalf("%s: expected span context %v, got %v", tc.name, want, got)
+		}
+		if tc.header && !got.IsRemote() {
+			t.Fatalf("%s: expected a remote span context", tc.name)
+		}
+	}
+}
+
+func TestTraceHTTPToNATS(t *testing.T) {
+	tracer, rec := recordSpans(t)
+	s := runServer(t)
+	nc := connectTest(t, s)
+
+	r := NewRouter(nc, "")
+	r.Use(Tracing(tracer))
+	if err := r.Handle("greet.{name}", func(ctx context.Context, msg *RouteMsg) error {
+		return msg.Respond([]byte("hello " + msg.Params["name"]))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Use(tracing.New(tracer))
+	app.Post("/greet/:name", func(c *fiber.Ctx) error {
+		msg := nats.NewMsg("greet." + c.Params("name"))
+		msg.Reply = nats.NewInbox()
+		sub, err := nc.SubscribeSync(msg.Reply)
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+		if err := PublishTraced(c.UserContext(), nc, tracer, msg); err != nil {
+			return err
+		}
+		reply, err := sub.NextMsg(defaultRPCTimeout)
+		if err != nil {
+			return err
+		}
+		return c.Send(reply.Data)
+	})
+
+	// The caller's trace, as another service would send it
+	const traceID, callerSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest("POST", "/greet/joe", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+callerSpan+"-01")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	// Wait for the route's span to end
+	if err := r.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	for _, tc := range []struct {
+		name   string
+		kind   trace.SpanKind
+		parent string // Span ID of the parent
+	}{
+		{"POST /greet/:name", trace.SpanKindServer, callerSpan},
+		{"publish greet.joe", trace.SpanKindProducer, spanID(spans["POST /greet/:name"])},
+		{"process greet.{name}", trace.SpanKindConsumer, spanID(spans["publish greet.joe"])},
+	} {
+		s, ok := spans[tc.name]
+		if !ok {
+			t.Fatalf("expected span %q, got %v", tc.name, spans)
+		}
+		if s.SpanContext().TraceID().String() != traceID {
+			t.Fatalf("%s: expected trace %s, got %s", tc.name, traceID, s.SpanContext().TraceID())
+		}
+		if s.Parent().SpanID().String() != tc.parent {
+			t.Fatalf("%s: expected parent %s, got %s", tc.name, tc.parent, s.Parent().SpanID())
+		}
+		if s.SpanKind() != tc.kind {
+			t.Fatalf("%s: expected kind %v, got %v", tc.name, tc.kind, s.SpanKind())
+		}
+	}
+}
+
+func spanID(s sdktrace.ReadOnlySpan) string {
+	if s == nil {
+		return ""
+	}
+	return s.SpanContext().SpanID().String()
+}
+
+func TestRPCPropagatesTrace(t *testing.T) {
+	tracer, _ := recordSpans(t)
+	nc := connectTest(t, runServer(t))
+	if _, err := Register(nc, "trace.echo", func(ctx context.Context, req string) (string, error) {
+		return trace.SpanContextFromContext(ctx).TraceID().String(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := tracer.Start(context.Background(), "caller")
+	defer span.End()
+	got, err := Call[string, string](ctx, nc, "trace.echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := span.SpanContext().TraceID().String(); got != want {
+		t.Fatalf("expected the handler in trace %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Error codes of replies sent by worker pools
+const (
+	CodeTimeout = "timeout" // The handler did not finish within WorkerConfig.Timeout
+	CodePanic   = "panic"
+)
+
+// WorkerConfig configures StartWorkers, zero fields take the defaults below
+type WorkerConfig struct {
+	Subject string // May contain wildcards, e.g. greet.*
+	Queue   string // Pools in the same queue group share the messages, defaults to Subject
+	Workers int    // Messages handled at the same time
+	Timeout time.Duration
+	// Messages and bytes received but not yet handled, beyond them messages are dropped
+	// and reported as slow consumer errors. -1 means no limit.
+	PendingMsgs  int
+	PendingBytes int
+	Logger       *slog.Logger
+}
+
+// Worker pool defaults
+const (
+	defaultWorkers      = 4
+	defaultWorkTimeout  = 30 * time.Second
+	defaultPendingMsgs  = 1024
+	defaultPendingBytes = 64 * 1024 * 1024
+)
+
+// WorkHandler handles one message, if it has a reply subject the result or error is sent back
+type WorkHandler func(ctx context.Context, msg *nats.Msg) ([]byte, error)
+
+// WorkerPool hands the messages of a queue subscription to a fixed number of goroutines
+type WorkerPool struct {
+	sub  *nats.Subscription
+	jobs chan *nats.Msg
+	wg   sync.WaitGroup
+
+	// quit makes the subscription give up handing messages over, mu keeps it from sending on closed jobs
+	mu       sync.RWMutex
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+// StartWorkers subscribes to cfg.Subject in a queue group and handles its messages with cfg.Workers goroutines
+func StartWorkers(nc *nats.Conn, cfg WorkerConfig, handler WorkHandler) (*WorkerPool, error) {
+	if cfg.Queue == "" {
+		cfg.Queue = cfg.Subject
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultWorkTimeout
+	}
+	if cfg.PendingMsgs == 0 {
+		cfg.PendingMsgs = defaultPendingMsgs
+	}
+	if cfg.PendingBytes == 0 {
+		cfg.PendingBytes = defaultPendingBytes
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	p := &WorkerPool{jobs: make(chan *nats.Msg), quit: make(chan struct{})}
+	// The subscription's goroutine blocks while every worker is busy, so messages queue up
+	// in the subscription, bounded by the pending limits
+	sub, err := nc.QueueSubscribe(cfg.Subject, cfg.Queue, p.dispatch)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe to %s: %w", cfg.Subject, err)
+	}
+	if err := sub.SetPendingLimits(cfg.PendingMsgs, cfg.PendingBytes); err != nil {
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("subscribe to %s: %w", cfg.Subject, err)
+	}
+	p.sub = sub
+
+	log := cfg.Logger.With("subject", cfg.Subject, "queue", cfg.Queue)
+	for i := 0; i < cfg.Workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range p.jobs {
+				data, err := work(msg, cfg.Timeout, handler)
+				if err != nil {
+					log.Error("handle message", "msg_subject", msg.Subject, "error", err)
+				}
+				if msg.Reply == "" {
+					continue
+				}
+				reply := &nats.Msg{Data: data}
+				if err != nil {
+					reply = errorReply(err)
+				}
+				if err := msg.RespondMsg(reply); err != nil {
+					log.Error("reply", "msg_subject", msg.Subject, "error", err)
+				}
+			}
+		}()
+	}
+	return p, nil
+}
+
+// dispatch hands msg to the next free worker, or drops it once the pool is stopping
+func (p *WorkerPool) dispatch(msg *nats.Msg) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	select {
+	case <-p.quit:
+		return
+	default:
+	}
+	select {
+	case p.jobs <- msg:
+	case <-p.quit:
+	}
+}
+
+// work runs handler with a timeout, turning a panic into an error
+func work(msg *nats.Msg, timeout time.Duration, handler WorkHandler) (data []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, NewRPCError(CodePanic, fmt.Sprint(r))
+		}
+	}()
+	data, err = handler(ctx, msg)
+	// A result that comes too late is not sent, the requester has given up
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, NewRPCError(CodeTimeout, fmt.Sprintf("not handled within %v", timeout))
+	}
+	return data, err
+}
+
+// Stop stops receiving messages, lets the workers finish the ones already received and waits for them.
+// If ctx is done first, the messages not handed to a worker yet are dropped and the workers still
+// busy exit once their handler returns, without being waited for.
+func (p *WorkerPool) Stop(ctx context.Context) error {
+	closed := p.sub.StatusChanged(nats.SubscriptionClosed)
+	err := p.sub.Drain()
+	if err == nil {
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	// The drain goes on without the workers: the messages still coming are dropped. Unsubscribing
+	// while draining would race with the drain's own removal of the subscription.
+	p.stopOnce.Do(func() {
+		close(p.quit)
+		// Waits for a dispatch still handing a message over
+		p.mu.Lock()
+		close(p.jobs)
+		p.mu.Unlock()
+	})
+	if err != nil {
+		return fmt.Errorf("stop workers: %w", err)
+	}
+	p.wg.Wait()
+	return nil
+}
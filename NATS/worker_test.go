@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// quietLogger discards the errors workers log for the failures the tests provoke
+var quietLogger = slog.New(slog.NewTextHandler(&logBuffer{}, nil))
+
+func TestWorkerPoolConcurrency(t *testing.T) {
+	s := runServer(t)
+	nc, client := connectTest(t, s), connectTest(t, s)
+
+	var inFlight, maxInFlight atomic.Int32
+	pool, err := StartWorkers(nc, WorkerConfig{Subject: "greet.*", Workers: 3, Logger: quietLogger}, func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		return []byte("hello " + msg.Subject[len("greet."):]), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint("user", i)
+			reply, err := client.Request("greet."+name, nil, 5*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(reply.Data) != "hello "+name {
+				t.Errorf("expected %q, got %q", "hello "+name, reply.Data)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := maxInFlight.Load(); got != 3 {
+		t.Fatalf("expected 3 messages handled at the same time, got %d", got)
+	}
+
+	if err := pool.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Request("greet.joe", nil, time.Second); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected no responders after stopping, got %v", err)
+	}
+}
+
+func TestWorkerPoolErrorReplies(t *testing.T) {
+	s := runServer(t)
+	nc, client := connectTest(t, s), connectTest(t, s)
+	_, err := StartWorkers(nc, WorkerConfig{Subject: "jobs", Timeout: 20 * time.Millisecond, Logger: quietLogger}, func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+		switch string(msg.Data) {
+		case "panic":
+			panic("boom")
+		case "slow":
+			<-ctx.Done()
+			return []byte("too late"), nil
+		}
+		return nil, errors.New("failed")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		data string
+		code string
+	}{
+		{"panic", CodePanic},
+		{"slow", CodeTimeout},
+		{"fail", CodeInternal},
+	} {
+		reply, err := client.Request("jobs", []byte(tc.data), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := reply.Header.Get(headerErrorCode); code != tc.code {
+			t.Fatalf("%s: expected error code %q, got %q (%s)", tc.data, tc.code, code, reply.Data)
+		}
+	}
+}
+
+func TestWorkerPoolQueueGroup(t *testing.T) {
+	s := runServer(t)
+	client := connectTest(t, s)
+
+	// Two replicas of the same consumer share the messages
+	var handled [2]atomic.Int32
+	var wg sync.WaitGroup
+	wg.Add(100)
+	for i := range handled {
+		nc := connectTest(t, s)
+		pool, err := StartWorkers(nc, WorkerConfig{Subject: "greet.*", PendingMsgs: 10, PendingBytes: 1024, Logger: quietLogger}, func(context.Context, *nats.Msg) ([]byte, error) {
+			handled[i].Add(1)
+			wg.Done()
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgs, bytes, err := pool.sub.PendingLimits(); err != nil || msgs != 10 || bytes != 1024 {
+			t.Fatalf("expected pending limits of 10 messages and 1024 bytes, got %d, %d, %v", msgs, bytes, err)
+		}
+		if err := nc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if err := client.Publish(fmt.Sprint("greet.user", i), nil); err != nil {
+			t.Fatal(err)
+		}
+		// Stay within the pending limits
+		if i%10 == 9 {
+			if err := client.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+	if a, b := handled[0].Load(), handled[1].Load(); a+b != 100 || a == 0 || b == 0 {
+		t.Fatalf("expected both replicas to handle some of the 100 messages once, got %d and %d", a, b)
+	}
+}
+
+func TestWorkerPoolStopTimeout(t *testing.T) {
+	s := runServer(t)
+	nc, client := connectTest(t, s), connectTest(t, s)
+
+	release := make(chan struct{})
+	var handled atomic.Int32
+	pool, err := StartWorkers(nc, WorkerConfig{Subject: "greet.*", Workers: 1, Logger: quietLogger}, func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+		handled.Add(1)
+		<-release
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// One message being handled, one waiting for the worker and one left in the subscription
+	for i := 0; i < 3; i++ {
+		if err := client.Publish(fmt.Sprint("greet.user", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := pool.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the stop to time out, got %v", err)
+	}
+	close(release)
+
+	// The busy worker exits once its handler returns instead of waiting for more messages
+	done := make(chan struct{})
+	go func() {
+		pool.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the workers to exit")
+	}
+	if got := handled.Load(); got != 1 {
+		t.Fatalf("expected the messages not handed over to be dropped, got %d handled", got)
+	}
+	if _, err := client.Request("greet.joe", nil, time.Second); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected no responders after stopping, got %v", err)
+	}
+	// Stopping again doesn't close the channels twice
+	if err := pool.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+// Expressions evaluated many times with different variables, such as pricing rules, are compiled
+// once to bytecode for a stack machine instead of walking the tree on every evaluation.
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+type opcode uint8
+
+const (
+	opConst opcode = iota // Push consts[arg]
+	opLoad                // Push the variable in slot arg
+	opStore               // Pop into temporary arg
+	opTemp                // Push temporary arg
+	opNeg
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opMod
+	opPow
+	opCall // Call funcs[arg] with the top argc values
+)
+
+var opNames = [...]string{"const", "load", "store", "temp", "neg", "add", "sub", "mul", "div", "mod", "pow", "call"}
+
+// Opcodes of the infix operators
+var binaryOps = map[byte]opcode{'+': opAdd, '-': opSub, '*': opMul, '/': opDiv, '%': opMod, '^': opPow}
+
+type instr struct {
+	op   opcode
+	argc uint8
+	arg  uint32
+}
+
+// Program is a compiled expression. Variables are bound by slot, in the order of Vars.
+type Program struct {
+	code     []instr
+	pos      []int // Position in the source of each instruction, for errors
+	consts   []float64
+	funcs    []builtin
+	names    []string // Of the functions, for String
+	vars     []string
+	temps    int // Arguments of inlined calls, evaluated once
+	maxStack int
+}
+
+// Calls of user functions are inlined, beyond this depth they are assumed to be recursive
+const maxInlineDepth = 64
+
+// Bounds the expanded tree, functions calling others several times can still grow it exponentially
+const maxNodes = 100_000
+
+// Compile compiles an expression using builtins and constants, its other names are variables
+func Compile(expr string) (*Program, error) {
+	return compile(expr, nil)
+}
+
+// Compile compiles an expression which may also call the calculator's functions, which are inlined.
+// Its variables are bound when running the program, not taken from the calculator.
+func (c *Calculator) Compile(expr string) (*Program, error) {
+	return compile(expr, c)
+}
+
+func compile(expr string, calc *Calculator) (*Program, error) {
+	n, err := parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	comp := &compiler{calc: calc, prog: &Program{}, slots: map[string]int{}}
+	if n, err = comp.expand(n, nil, -1, 0); err != nil {
+		return nil, err
+	}
+	comp.emit(n)
+	return comp.prog, nil
+}
+
+type compiler struct {
+	calc  *Calculator
+	prog  *Program
+	slots map[string]int // Of the variables
+	stack int
+	nodes int // Expanded so far
+}
+
+// letNode evaluates an argument of an inlined call once into a temporary, which body reads with tempNodes
+type letNode struct {
+	slot        int
+	value, body node
+	at          int
+}
+
+type tempNode struct {
+	slot int
+	at   int
+}
+
+func (n *letNode) pos() int  { return n.at }
+func (n *tempNode) pos() int { return n.at }
+
+// expand returns n with user functions inlined, constants replaced by their value and the
+// operations on constants folded. Inside an inlined body, params holds the expanded arguments
+// and at is the position of the outermost call, to which errors are reported.
+func (c *compiler) expand(n node, params map[string]node, at, depth int) (node, error) {
+	pos := n.pos()
+	if at >= 0 {
+		pos = at
+	}
+	if c.nodes++; c.nodes > maxNodes {
+		return nil, errorAt(pos, "more than %d operations once functions are inlined, too large to compile", maxNodes)
+	}
+	switch n := n.(type) {
+	case *numberNode:
+		return &numberNode{value: n.value, at: pos}, nil
+	case *varNode:
+		if arg, ok := params[n.name]; ok {
+			return arg, nil
+		}
+		if v, ok := constants[n.name]; ok {
+			return &numberNode{value: v, at: pos}, nil
+		}
+		return &varNode{name: n.name, at: pos}, nil
+	case *unaryNode:
+		operand, err := c.expand(n.operand, params, at, depth)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == '+' {
+			return operand, nil
+		}
+		if x, ok := operand.(*numberNode); ok {
+			return &numberNode{value: -x.value, at: pos}, nil
+		}
+		return &unaryNode{op: n.op, operand: operand, at: pos}, nil
+	case *binaryNode:
+		left, err := c.expand(n.left, params, at, depth)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.expand(n.right, params, at, depth)
+		if err != nil {
+			return nil, err
+		}
+		l, lok := left.(*numberNode)
+		r, rok := right.(*numberNode)
+		if lok && rok {
+			// Errors such as a division by zero are reported when compiling
+			v, err := applyBinary(n.op, l.value, r.value, pos)
+			if err != nil {
+				return nil, err
+			}
+			return &numberNode{value: v, at: pos}, nil
+		}
+		return &binaryNode{op: n.op, left: left, right: right, at: pos}, nil
+	case *callNode:
+		call := &callNode{name: n.name, args: make([]node, len(n.args)), at: pos}
+		constant := true
+		for i, arg := range n.args {
+			var err error
+			if call.args[i], err = c.expand(arg, params, at, depth); err != nil {
+				return nil, err
+			}
+			_, ok := call.args[i].(*numberNode)
+			constant = constant && ok
+		}
+		if _, ok := builtins[n.name]; ok {
+			if !constant {
+				if err := checkArity(call, builtins[n.name].arity, len(call.args)); err != nil {
+					return nil, err
+				}
+				if len(call.args) > math.MaxUint8 {
+					return nil, errorAt(call.at, "%s: more than %d arguments", call.name, math.MaxUint8)
+				}
+				return call, nil
+			}
+			// Builtins are pure, a call on constants is a constant
+			args := make([]float64, len(call.args))
+			for i, arg := range call.args {
+				args[i] = arg.(*numberNode).value
+			}
+			v, err := (&scope{}).call(call, args)
+			if err != nil {
+				return nil, err
+			}
+			return &numberNode{value: v, at: pos}, nil
+		}
+		return c.inline(call, at, depth)
+	default:
+		panic(fmt.Sprintf("expand: unexpected node %T", n))
+	}
+}
+
+// inline returns the body of the user function called by call, on its expanded arguments
+func (c *compiler) inline(call *callNode, at, depth int) (node, error) {
+	var f *userFunc
+	if c.calc != nil {
+		f = c.calc.funcs[call.name]
+	}
+	if f == nil {
+		return nil, errorAt(call.at, "undefined function %s", call.name)
+	}
+	if err := checkArity(call, len(f.params), len(call.args)); err != nil {
+		return nil, err
+	}
+	if depth >= maxInlineDepth {
+		return nil, errorAt(call.at, "%s: calls nested more than %d deep, recursive functions can't be compiled", call.name, maxInlineDepth)
+	}
+	if at < 0 {
+		at = call.at
+	}
+	// Arguments used once, constants and variables are substituted, the others are evaluated once
+	// into a temporary: substituting them would repeat their code for every use
+	params := make(map[string]node, len(f.params))
+	var lets []*letNode
+	for i, p := range f.params {
+		switch arg := call.args[i].(type) {
+		case *numberNode, *varNode, *tempNode:
+			params[p] = arg
+		default:
+			if uses(f.body, p) == 1 {
+				params[p] = arg
+				continue
+			}
+			let := &letNode{slot: c.prog.temps, value: arg, at: at}
+			c.prog.temps++
+			params[p] = &tempNode{slot: let.slot, at: at}
+			lets = append(lets, let)
+		}
+	}
+	body, err := c.expand(f.body, params, at, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(lets) - 1; i >= 0; i-- {
+		lets[i].body, body = body, lets[i]
+	}
+	return body, nil
+}
+
+// uses counts the references to the parameter name in a function's body
+func uses(n node, name string) int {
+	switch n := n.(type) {
+	case *varNode:
+		if n.name == name {
+			return 1
+		}
+	case *unaryNode:
+		return uses(n.operand, name)
+	case *binaryNode:
+		return uses(n.left, name) + uses(n.right, name)
+	case *callNode:
+		count := 0
+		for _, arg := range n.args {
+			count += uses(arg, name)
+		}
+		return count
+	}
+	return 0
+}
+
+// emit appends the code of an expanded tree
+func (c *compiler) emit(n node) {
+	switch n := n.(type) {
+	case *numberNode:
+		// Compared by bits, so -0 and 0 stay apart
+		i := slices.IndexFunc(c.prog.consts, func(v float64) bool { return math.Float64bits(v) == math.Float64bits(n.value) })
+		if i < 0 {
+			i = len(c.prog.consts)
+			c.prog.consts = append(c.prog.consts, n.value)
+		}
+		c.add(instr{op: opConst, arg: uint32(i)}, n.at, 1)
+	case *varNode:
+		slot, ok := c.slots[n.name]
+		if !ok {
+			slot = len(c.prog.vars)
+			c.slots[n.name] = slot
+			c.prog.vars = append(c.prog.vars, n.name)
+		}
+		c.add(instr{op: opLoad, arg: uint32(slot)}, n.at, 1)
+	case *letNode:
+		c.emit(n.value)
+		c.add(instr{op: opStore, arg: uint32(n.slot)}, n.at, -1)
+		c.emit(n.body)
+	case *tempNode:
+		c.add(instr{op: opTemp, arg: uint32(n.slot)}, n.at, 1)
+	case *unaryNode:
+		c.emit(n.operand)
+		c.add(instr{op: opNeg}, n.at, 0)
+	case *binaryNode:
+		c.emit(n.left)
+		c.emit(n.right)
+		c.add(instr{op: binaryOps[n.op]}, n.at, -1)
+	case *callNode:
+		for _, arg := range n.args {
+			c.emit(arg)
+		}
+		i := slices.Index(c.prog.names, n.name)
+		if i < 0 {
+			i = len(c.prog.funcs)
+			c.prog.funcs = append(c.prog.funcs, builtins[n.name])
+			c.prog.names = append(c.prog.names, n.name)
+		}
+		c.add(instr{op: opCall, argc: uint8(len(n.args)), arg: uint32(i)}, n.at, 1-len(n.args))
+	default:
+		panic(fmt.Sprintf("emit: unexpected node %T", n))
+	}
+}
+
+// add appends in, which changes the stack's depth by delta
+func (c *compiler) add(in instr, pos, delta int) {
+	c.prog.code = append(c.prog.code, in)
+	c.prog.pos = append(c.prog.pos, pos)
+	c.stack += delta
+	c.prog.maxStack = max(c.prog.maxStack, c.stack)
+}
+
+// Vars returns the names of the variables, in the order Run takes their values
+func (p *Program) Vars() []string {
+	return p.vars
+}
+
+// Eval runs the program with the variables of vars
+func (p *Program) Eval(vars map[string]float64) (float64, error) {
+	values := make([]float64, len(p.vars))
+	for i, name := range p.vars {
+		v, ok := vars[name]
+		if !ok {
+			return 0, fmt.Errorf("variable %s not set", name)
+		}
+		values[i] = v
+	}
+	return p.Run(values)
+}
+
+// Run runs the program with the values of its variables, in the order of Vars
+func (p *Program) Run(values []float64) (float64, error) {
+	if len(values) != len(p.vars) {
+		return 0, fmt.Errorf("expected %d variables %v, got %d values", len(p.vars), p.vars, len(values))
+	}
+	stack := make([]float64, p.maxStack)
+	temps := make([]float64, p.temps)
+	sp := 0
+	for i, in := range p.code {
+		switch in.op {
+		case opConst:
+			stack[sp] = p.consts[in.arg]
+			sp++
+		case opLoad:
+			stack[sp] = values[in.arg]
+			sp++
+		case opStore:
+			sp--
+			temps[in.arg] = stack[sp]
+		case opTemp:
+			stack[sp] = temps[in.arg]
+			sp++
+		case opNeg:
+			stack[sp-1] = -stack[sp-1]
+		case opAdd:
+			sp--
+			stack[sp-1] += stack[sp]
+		case opSub:
+			sp--
+			stack[sp-1] -= stack[sp]
+		case opMul:
+			sp--
+			stack[sp-1] *= stack[sp]
+		case opDiv, opMod, opPow:
+			sp--
+			v, err := applyBinary("/%^"[in.op-opDiv], stack[sp-1], stack[sp], p.pos[i])
+			if err != nil {
+				return 0, err
+			}
+			stack[sp-1] = v
+		case opCall:
+			sp -= int(in.argc)
+			v, err := p.funcs[in.arg].fn(stack[sp : sp+int(in.argc)])
+			if err != nil {
+				return 0, errorAt(p.pos[i], "%s: %v", p.names[in.arg], err)
+			}
+			stack[sp] = v
+			sp++
+		}
+	}
+	return stack[0], nil
+}
+
+// String disassembles the program, one instruction per line
+func (p *Program) String() string {
+	var b strings.Builder
+	for _, in := range p.code {
+		b.WriteString(opNames[in.op])
+		switch in.op {
+		case opConst:
+			fmt.Fprintf(&b, " %s", formatNumber(p.consts[in.arg]))
+		case opLoad:
+			fmt.Fprintf(&b, " %s", p.vars[in.arg])
+		case opStore, opTemp:
+			fmt.Fprintf(&b, " #%d", in.arg)
+		case opCall:
+			fmt.Fprintf(&b, " %s %d", p.names[in.arg], in.argc)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
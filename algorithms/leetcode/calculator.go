@@ -1,57 +1,621 @@
 package main
 
 // Given a string s representing a valid expression, implement a basic calculator to evaluate it, and return the result of the evaluation.
+// Beyond the exercise's + - and parentheses, it handles * / % ^, unary minus and floats, and reports
+// where invalid expressions go wrong instead of returning garbage.
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
 )
 
-func find_end(s string) int {
-	counter := 1
-	for pos, char := range s {
-		switch char {
-		case '(':
-			counter += 1
-		case ')':
-			counter -= 1
-		}
-		if counter == 0 {
-			return pos
-		}
-	}
-	return -1
-}
-
-func calculate(s string) int {
-	res := 0
-	sign := 1
-	last := 0
-	s = strings.Replace(s, " ", "", -1)
-	for pos, char := range s {
-		switch char {
-		case '(':
-			{
-				end := find_end(s[pos+1:]) + pos + 1
-				return res + sign*calculate(s[pos+1:end]) + calculate(s[end+1:])
+// CalcError is an invalid expression, or one that can't be evaluated such as a division by zero
+type CalcError struct {
+	Pos int // Byte offset in the expression
+	Msg string
+}
+
+func (e *CalcError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+func errorAt(pos int, format string, args ...any) *CalcError {
+	return &CalcError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenIdent
+	tokenComma
+	tokenAssign
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value float64 // Of numbers
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// tokenize splits s into numbers, names, operators and punctuation, skipping spaces
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case isDigit(c) || c == '.':
+			end := scanNumber(s, i)
+			value, err := strconv.ParseFloat(s[i:end], 64)
+			if err != nil {
+				return nil, errorAt(i, "invalid number %q", s[i:end])
 			}
-		case '-':
-			{
-				sign = -1
-				last = 0
+			tokens = append(tokens, token{kind: tokenNumber, text: s[i:end], value: value, pos: i})
+			i = end
+		case isLetter(c):
+			end := i + 1
+			for end < len(s) && (isLetter(s[end]) || isDigit(s[end])) {
+				end++
 			}
-		case '+':
-			{
-				sign = 1
-				last = 0
+			tokens = append(tokens, token{kind: tokenIdent, text: s[i:end], pos: i})
+			i = end
+		case c == '(' || c == ')' || c == ',' || c == '=':
+			kind := map[byte]tokenKind{'(': tokenLParen, ')': tokenRParen, ',': tokenComma, '=': tokenAssign}[c]
+			tokens = append(tokens, token{kind: kind, text: s[i : i+1], pos: i})
+			i++
+		case isOperator(c):
+			tokens = append(tokens, token{kind: tokenOperator, text: s[i : i+1], pos: i})
+			i++
+		default:
+			return nil, errorAt(i, "unexpected character %q", rune(s[i]))
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s)}), nil
+}
+
+// scanNumber returns the end of the number starting at i: digits with an optional fraction and exponent
+func scanNumber(s string, i int) int {
+	for i < len(s) && (isDigit(s[i]) || s[i] == '.') {
+		i++
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for i = j; i < len(s) && isDigit(s[i]); i++ {
 			}
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+func isOperator(c byte) bool {
+	switch c {
+	case '+', '-', '*', '/', '%', '^':
+		return true
+	}
+	return false
+}
+
+// node is the syntax tree of an expression
+type node interface {
+	pos() int
+}
+
+type numberNode struct {
+	value float64
+	at    int
+}
+
+type unaryNode struct {
+	op      byte
+	operand node
+	at      int
+}
+
+type binaryNode struct {
+	op          byte
+	left, right node
+	at          int // Of the operator
+}
+
+// varNode is a variable, or a parameter inside a function's body
+type varNode struct {
+	name string
+	at   int
+}
+
+type callNode struct {
+	name string
+	args []node
+	at   int
+}
+
+func (n *numberNode) pos() int { return n.at }
+func (n *unaryNode) pos() int  { return n.at }
+func (n *binaryNode) pos() int { return n.at }
+func (n *varNode) pos() int    { return n.at }
+func (n *callNode) pos() int   { return n.at }
+
+// Binding powers of the infix operators, left and right. Left-associative operators bind
+// tighter on the right, ^ is right-associative.
+var infixPower = map[byte][2]int{
+	'+': {1, 2}, '-': {1, 2},
+	'*': {3, 4}, '/': {3, 4}, '%': {3, 4},
+	'^': {7, 6},
+}
+
+// Binding power of unary + and -, below ^ so -2^2 is -(2^2)
+const prefixPower = 5
+
+// parser is a Pratt parser over the tokens of an expression
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+// parse parses a whole expression
+func parse(s string) (node, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokens(tokens)
+}
+
+// parseTokens parses tokens, ending with tokenEOF, as a whole expression
+func parseTokens(tokens []token) (node, error) {
+	p := &parser{tokens: tokens}
+	n, err := p.expression(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, errorAt(t.pos, "unexpected %s", t)
+	}
+	return n, nil
+}
+
+// expression parses the operators binding tighter than minPower
+func (p *parser) expression(minPower int) (node, error) {
+	left, err := p.prefix()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator {
+			return left, nil
+		}
+		power := infixPower[t.text[0]]
+		if power[0] < minPower {
+			return left, nil
+		}
+		p.next()
+		right, err := p.expression(power[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.text[0], left: left, right: right, at: t.pos}
+	}
+}
+
+// prefix parses a number, a variable, a call, a parenthesized expression or a unary operator and its operand
+func (p *parser) prefix() (node, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenNumber:
+		return &numberNode{value: t.value, at: t.pos}, nil
+	case t.kind == tokenIdent && p.peek().kind == tokenLParen:
+		return p.call(t)
+	case t.kind == tokenIdent:
+		return &varNode{name: t.text, at: t.pos}, nil
+	case t.kind == tokenOperator && (t.text == "-" || t.text == "+"):
+		operand, err := p.expression(prefixPower)
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: t.text[0], operand: operand, at: t.pos}, nil
+	case t.kind == tokenLParen:
+		n, err := p.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, errorAt(closing.pos, "expected \")\" closing the \"(\" at position %d, got %s", t.pos, closing)
+		}
+		return n, nil
+	default:
+		return nil, errorAt(t.pos, "expected a number, a name or \"(\", got %s", t)
+	}
+}
+
+// call parses the arguments of a call to name
+func (p *parser) call(name token) (node, error) {
+	open := p.next()
+	n := &callNode{name: name.text, at: name.pos}
+	if p.peek().kind == tokenRParen {
+		p.next()
+		return n, nil
+	}
+	for {
+		arg, err := p.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, arg)
+		switch t := p.next(); t.kind {
+		case tokenComma:
+		case tokenRParen:
+			return n, nil
 		default:
-			{
-				x := sign * int(char-'0')
-				res += last*9 + x
-				last = last*10 + x
+			return nil, errorAt(t.pos, "expected \",\" or \")\" closing the \"(\" at position %d, got %s", open.pos, t)
+		}
+	}
+}
+
+// statement is a line of the calculator: an expression, an assignment (x = 3*4)
+// or a function definition (f(x) = x^2+1)
+type statement struct {
+	name   string   // Assigned variable or defined function, empty for expressions
+	params []string // Of a defined function
+	isFunc bool
+	expr   node
+}
+
+// parseStatement parses a line of the calculator
+func parseStatement(s string) (*statement, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	assign := -1
+	for i, t := range tokens {
+		if t.kind == tokenAssign {
+			assign = i
+			break
+		}
+	}
+	if assign < 0 {
+		n, err := parseTokens(tokens)
+		if err != nil {
+			return nil, err
+		}
+		return &statement{expr: n}, nil
+	}
+
+	st, err := parseTarget(tokens[:assign], tokens[assign])
+	if err != nil {
+		return nil, err
+	}
+	if st.expr, err = parseTokens(tokens[assign+1:]); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// parseTarget parses what is left of =, a name or a name and its parameters
+func parseTarget(lhs []token, assign token) (*statement, error) {
+	if len(lhs) == 0 || lhs[0].kind != tokenIdent {
+		return nil, errorAt(assign.pos, "expected a name or a function before \"=\"")
+	}
+	st := &statement{name: lhs[0].text}
+	if len(lhs) == 1 {
+		return st, nil
+	}
+	st.isFunc = true
+	if lhs[1].kind != tokenLParen || lhs[len(lhs)-1].kind != tokenRParen {
+		return nil, errorAt(lhs[1].pos, "expected the parameters of %s in parentheses", st.name)
+	}
+	params := lhs[2 : len(lhs)-1]
+	for i, t := range params {
+		switch {
+		case i%2 == 0 && t.kind == tokenIdent:
+			if slices.Contains(st.params, t.text) {
+				return nil, errorAt(t.pos, "parameter %s repeated", t.text)
 			}
+			st.params = append(st.params, t.text)
+		case i%2 == 1 && t.kind == tokenComma && i < len(params)-1:
+		default:
+			return nil, errorAt(t.pos, "expected a parameter name, got %s", t)
+		}
+	}
+	return st, nil
+}
+
+// Predefined variables, which can't be assigned
+var constants = map[string]float64{"pi": math.Pi, "e": math.E}
+
+// builtin is a predefined function taking arity arguments, or at least one if arity is -1
+type builtin struct {
+	arity int
+	fn    func(args []float64) (float64, error)
+}
+
+func mathFunc(fn func(float64) float64) builtin {
+	return builtin{1, func(args []float64) (float64, error) { return fn(args[0]), nil }}
+}
+
+var builtins = map[string]builtin{
+	"sin":   mathFunc(math.Sin),
+	"cos":   mathFunc(math.Cos),
+	"tan":   mathFunc(math.Tan),
+	"abs":   mathFunc(math.Abs),
+	"exp":   mathFunc(math.Exp),
+	"floor": mathFunc(math.Floor),
+	"ceil":  mathFunc(math.Ceil),
+	"round": mathFunc(math.Round),
+	"sqrt": {1, func(args []float64) (float64, error) {
+		if args[0] < 0 {
+			return 0, errors.New("square root of a negative number")
+		}
+		return math.Sqrt(args[0]), nil
+	}},
+	"ln": {1, func(args []float64) (float64, error) {
+		if args[0] <= 0 {
+			return 0, errors.New("logarithm of a number that is not positive")
 		}
+		return math.Log(args[0]), nil
+	}},
+	"pow": {2, func(args []float64) (float64, error) { return power(args[0], args[1]), nil }},
+	"min": {-1, func(args []float64) (float64, error) { return slices.Min(args), nil }},
+	"max": {-1, func(args []float64) (float64, error) { return slices.Max(args), nil }},
+}
+
+// userFunc is a function defined with f(x) = ...
+type userFunc struct {
+	params []string
+	body   node
+	source string // The definition, as typed
+}
+
+// Nested calls beyond this are reported rather than overflowing the stack, e.g. for f(x) = f(x)
+const maxCallDepth = 1000
+
+// Calculator evaluates statements, remembering the variables and functions they define
+type Calculator struct {
+	vars  map[string]float64
+	funcs map[string]*userFunc
+}
+
+func NewCalculator() *Calculator {
+	return &Calculator{vars: make(map[string]float64), funcs: make(map[string]*userFunc)}
+}
+
+// Eval runs a line: expressions and assignments return their value, definitions 0
+func (c *Calculator) Eval(line string) (float64, error) {
+	st, err := parseStatement(line)
+	if err != nil {
+		return 0, err
 	}
+	return c.exec(st, line)
+}
+
+func (c *Calculator) exec(st *statement, line string) (float64, error) {
+	switch {
+	case st.isFunc:
+		if _, ok := builtins[st.name]; ok {
+			return 0, errorAt(0, "%s is a builtin function", st.name)
+		}
+		c.funcs[st.name] = &userFunc{params: st.params, body: st.expr, source: strings.TrimSpace(line)}
+		return 0, nil
+	case st.name != "":
+		if _, ok := constants[st.name]; ok {
+			return 0, errorAt(0, "%s is a constant", st.name)
+		}
+		v, err := (&scope{calc: c}).eval(st.expr)
+		if err != nil {
+			return 0, err
+		}
+		c.vars[st.name] = v
+		return v, nil
+	default:
+		return (&scope{calc: c}).eval(st.expr)
+	}
+}
 
-	return res
+// scope evaluates nodes, in the body of a user function if locals holds its arguments
+type scope struct {
+	calc   *Calculator // Nil for plain expressions, which only know constants and builtins
+	locals map[string]float64
+	depth  int
+}
+
+func (s *scope) lookup(name string) (float64, bool) {
+	if v, ok := s.locals[name]; ok {
+		return v, true
+	}
+	if s.calc != nil {
+		if v, ok := s.calc.vars[name]; ok {
+			return v, true
+		}
+	}
+	v, ok := constants[name]
+	return v, ok
+}
+
+// eval evaluates the tree of n
+func (s *scope) eval(n node) (float64, error) {
+	switch n := n.(type) {
+	case *numberNode:
+		return n.value, nil
+	case *varNode:
+		v, ok := s.lookup(n.name)
+		if !ok {
+			return 0, errorAt(n.at, "undefined variable %s", n.name)
+		}
+		return v, nil
+	case *unaryNode:
+		x, err := s.eval(n.operand)
+		if err != nil {
+			return 0, err
+		}
+		if n.op == '-' {
+			return -x, nil
+		}
+		return x, nil
+	case *binaryNode:
+		l, err := s.eval(n.left)
+		if err != nil {
+			return 0, err
+		}
+		r, err := s.eval(n.right)
+		if err != nil {
+			return 0, err
+		}
+		return applyBinary(n.op, l, r, n.at)
+	case *callNode:
+		args := make([]float64, len(n.args))
+		for i, arg := range n.args {
+			v, err := s.eval(arg)
+			if err != nil {
+				return 0, err
+			}
+			args[i] = v
+		}
+		return s.call(n, args)
+	default:
+		panic(fmt.Sprintf("eval: unexpected node %T", n))
+	}
+}
+
+// call calls the builtin or user function of n
+func (s *scope) call(n *callNode, args []float64) (float64, error) {
+	if b, ok := builtins[n.name]; ok {
+		if err := checkArity(n, b.arity, len(args)); err != nil {
+			return 0, err
+		}
+		v, err := b.fn(args)
+		if err != nil {
+			return 0, errorAt(n.at, "%s: %v", n.name, err)
+		}
+		return v, nil
+	}
+	var f *userFunc
+	if s.calc != nil {
+		f = s.calc.funcs[n.name]
+	}
+	if f == nil {
+		return 0, errorAt(n.at, "undefined function %s", n.name)
+	}
+	if err := checkArity(n, len(f.params), len(args)); err != nil {
+		return 0, err
+	}
+	if s.depth >= maxCallDepth {
+		return 0, errorAt(n.at, "%s: calls nested more than %d deep", n.name, maxCallDepth)
+	}
+	locals := make(map[string]float64, len(args))
+	for i, p := range f.params {
+		locals[p] = args[i]
+	}
+	v, err := (&scope{calc: s.calc, locals: locals, depth: s.depth + 1}).eval(f.body)
+	if err != nil {
+		// Positions in the body are relative to the definition, not to this line
+		return 0, errorAt(n.at, "in %s: %v", f.source, err)
+	}
+	return v, nil
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+func checkArity(n *callNode, arity, got int) error {
+	switch {
+	case arity < 0 && got == 0:
+		return errorAt(n.at, "%s takes at least 1 argument, got none", n.name)
+	case arity >= 0 && got != arity:
+		return errorAt(n.at, "%s takes %s, got %d", n.name, plural(arity, "argument"), got)
+	}
+	return nil
+}
+
+// applyBinary applies the infix operator op at position pos
+func applyBinary(op byte, l, r float64, pos int) (float64, error) {
+	switch op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, errorAt(pos, "division by zero")
+		}
+		return l / r, nil
+	case '%':
+		if r == 0 {
+			return 0, errorAt(pos, "modulo by zero")
+		}
+		return math.Mod(l, r), nil
+	case '^':
+		return power(l, r), nil
+	default:
+		panic(fmt.Sprintf("applyBinary: unexpected operator %q", op))
+	}
+}
+
+// power is x^y, with myPow for integer exponents
+func power(x, y float64) float64 {
+	if y != math.Trunc(y) || math.Abs(y) > math.MaxInt32 {
+		return math.Pow(x, y)
+	}
+	// 1/x^n is exact more often than (1/x)^n, e.g. 10^-2
+	if y < 0 {
+		return 1 / myPow(x, int(-y))
+	}
+	return myPow(x, int(y))
+}
+
+// calculate evaluates the expression s
+func calculate(s string) (float64, error) {
+	n, err := parse(s)
+	if err != nil {
+		return 0, err
+	}
+	return (&scope{}).eval(n)
 }
@@ -0,0 +1,58 @@
+package main
+
+// The original solution of the exercise, integers with + - and parentheses only, kept as the
+// baseline of the calculator benchmarks.
+
+import (
+	"strings"
+)
+
+func findEnd(s string) int {
+	counter := 1
+	for pos, char := range s {
+		switch char {
+		case '(':
+			counter += 1
+		case ')':
+			counter -= 1
+		}
+		if counter == 0 {
+			return pos
+		}
+	}
+	return -1
+}
+
+func calculateRecursive(s string) int {
+	res := 0
+	sign := 1
+	last := 0
+	s = strings.Replace(s, " ", "", -1)
+	for pos, char := range s {
+		switch char {
+		case '(':
+			{
+				end := findEnd(s[pos+1:]) + pos + 1
+				return res + sign*calculateRecursive(s[pos+1:end]) + calculateRecursive(s[end+1:])
+			}
+		case '-':
+			{
+				sign = -1
+				last = 0
+			}
+		case '+':
+			{
+				sign = 1
+				last = 0
+			}
+		default:
+			{
+				x := sign * int(char-'0')
+				res += last*9 + x
+				last = last*10 + x
+			}
+		}
+	}
+
+	return res
+}
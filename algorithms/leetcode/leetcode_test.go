@@ -1,6 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -11,3 +16,379 @@ func TestMyPow(t *testing.T) {
 		t.Fatalf("expected %f, got %f", res, expected)
 	}
 }
+
+func TestCalculate(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected float64
+	}{
+		{"1 + 1", 2},
+		{" 2-1 + 2 ", 3},
+		{"(1+(4+5+2)-3)+(6+8)", 23},
+		{"1 - -(2+3)", 6},
+		{"10 - (2+3) - (1)", 4},
+		{"-(2+3)", -5},
+		{"2 + 3 * 4", 14},
+		{"(2 + 3) * 4", 20},
+		{"7 / 2", 3.5},
+		{"7 % 4 * 2", 6},
+		{"8 / 4 / 2", 1},
+		{"2 - 3 - 4", -5},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"(-2) ^ 2", 4},
+		{"2 ^ -1", 0.5},
+		{"10 ^ -2", 0.01},
+		{"4 ^ 0.5", 2},
+		{"1.5 * .5 + 1e3", 1000.75},
+		{"2.5e-1 * 4", 1},
+		{"+3 * -2", -6},
+		{"2 * -3 ^ 2", -18},
+	} {
+		res, err := calculate(tc.expr)
+		if err != nil {
+			t.Fatalf("%q: expected %v, got error %v", tc.expr, tc.expected, err)
+		}
+		if math.Abs(res-tc.expected) > 1e-9 {
+			t.Fatalf("%q: expected %v, got %v", tc.expr, tc.expected, res)
+		}
+	}
+}
+
+func TestCalculateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{"", 0, "expected a number"},
+		{"1 +", 3, "expected a number"},
+		{"2 * (3 + 4", 10, `closing the "(" at position 4`},
+		{"2 + 3)", 5, `unexpected ")"`},
+		{"2 3", 2, `unexpected "3"`},
+		{"2 $ 3", 2, "unexpected character"},
+		{"1.2.3", 0, "invalid number"},
+		{"4 * ()", 5, `got ")"`},
+		{"1 / (2 - 2)", 2, "division by zero"},
+		{"1 % 0", 2, "modulo by zero"},
+	} {
+		_, err := calculate(tc.expr)
+		var calcErr *CalcError
+		if !errors.As(err, &calcErr) {
+			t.Fatalf("%q: expected a CalcError, got %v", tc.expr, err)
+		}
+		if calcErr.Pos != tc.pos || !strings.Contains(calcErr.Msg, tc.msg) {
+			t.Fatalf("%q: expected %q at %d, got %q at %d", tc.expr, tc.msg, tc.pos, calcErr.Msg, calcErr.Pos)
+		}
+	}
+}
+
+func TestCalculatorStatements(t *testing.T) {
+	calc := NewCalculator()
+	// Lines run in order on the same calculator
+	for _, tc := range []struct {
+		line     string
+		expected float64
+		err      string
+	}{
+		{"x = 3*4", 12, ""},
+		{"x / 4", 3, ""},
+		{"f(x) = x^2 + 1", 0, ""},
+		{"f(3)", 10, ""},
+		{"f(x) + x", 157, ""},
+		{"hyp(a, b) = sqrt(a^2 + b^2)", 0, ""},
+		{"hyp(3, 4)", 5, ""},
+		{"scaled(a) = a * x", 0, ""},
+		{"x = 2", 2, ""},
+		{"scaled(5)", 10, ""},
+		{"pow(2, 10) + max(1, 7, 3) - min(4, 2)", 1029, ""},
+		{"round(sin(pi / 2) * 100) + abs(-1)", 101, ""},
+		{"ln(e)", 1, ""},
+		{"y", 0, "position 0: undefined variable y"},
+		{"g(1)", 0, "position 0: undefined function g"},
+		{"f(1, 2)", 0, "position 0: f takes 1 argument, got 2"},
+		{"max()", 0, "max takes at least 1 argument"},
+		{"sqrt(-1)", 0, "square root of a negative number"},
+		{"inv(a) = 1 / a", 0, ""},
+		{"2 + inv(0)", 0, "position 4: in inv(a) = 1 / a: position 11: division by zero"},
+		{"loop(a) = loop(a)", 0, ""},
+		{"loop(1)", 0, "nested more than"},
+		{"pi = 3", 0, "pi is a constant"},
+		{"sin(x) = x", 0, "sin is a builtin function"},
+		{"f(a, a) = a", 0, "parameter a repeated"},
+		{"f(1) = 2", 0, "expected a parameter name"},
+		{"3 = x", 0, `expected a name or a function before "="`},
+		{"x = ", 0, "expected a number"},
+		{"f(1,)", 0, "expected a number"},
+	} {
+		res, err := calc.Eval(tc.line)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%q: expected error %q, got %v", tc.line, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: expected %v, got error %v", tc.line, tc.expected, err)
+		}
+		if math.Abs(res-tc.expected) > 1e-9 {
+			t.Fatalf("%q: expected %v, got %v", tc.line, tc.expected, res)
+		}
+	}
+
+	// Plain expressions know builtins and constants only
+	if _, err := calculate("x + 1"); err == nil {
+		t.Fatal("expected calculate to reject variables")
+	}
+	if res, err := calculate("pow(2, 3) * pi / pi"); err != nil || res != 8 {
+		t.Fatalf("expected 8, got %v %v", res, err)
+	}
+}
+
+func TestREPL(t *testing.T) {
+	input := strings.Join([]string{
+		"x = 3*4", "f(x) = x^2+1", "f(2) + x", ":vars", ":funcs", "1 +", "!1", "!9", ":history", "   1 +", "!4", ":quit", "2",
+	}, "\n")
+	var out strings.Builder
+	if err := repl(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"> 12\n",
+		"> defined f\n",
+		"> 17\n",
+		"> x = 12\n",
+		"> f(x) = x^2+1\n",
+		// The caret points under the error as shown: after the prompt, the typed spaces or neither
+		"> " + strings.Repeat(" ", 5) + "^\nerror: position 3: expected a number",
+		"> " + strings.Repeat(" ", 8) + "^\nerror: position 3: expected a number",
+		"> 1 +\n   ^\nerror: position 3: expected a number",
+		"> x = 3*4\n12\n",
+		"no line 9 in the history",
+		"1  x = 3*4\n2  f(x) = x^2+1\n3  f(2) + x\n4  1 +\n5  x = 3*4\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in the output, got\n%s", want, out.String())
+		}
+	}
+	if strings.HasSuffix(out.String(), "2\n") {
+		t.Fatalf("expected nothing to run after :quit, got\n%s", out.String())
+	}
+}
+
+func TestCompile(t *testing.T) {
+	calc := NewCalculator()
+	for _, line := range []string{"sq(x) = x^2", "discounted(p, pct) = p * (1 - pct/100)", "twice(x) = x + x"} {
+		if _, err := calc.Eval(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		expr string
+		code string // Disassembly, showing what was folded
+	}{
+		{"2 * 3 + x", "const 6\nload x\nadd\n"},
+		{"-(2 ^ 3) * pi / pi", "const -8\n"},
+		{"max(1, 5, sqrt(16)) - x", "const 5\nload x\nsub\n"},
+		{"x * 2 * 3", "load x\nconst 2\nmul\nconst 3\nmul\n"},
+		{"sq(y + 1)", "load y\nconst 1\nadd\nconst 2\npow\n"},
+		{"discounted(price, 10 + 5) * qty", "load price\nconst 0.85\nmul\nload qty\nmul\n"},
+		{"max(x, y, 0) % -x", "load x\nload y\nconst 0\ncall max 3\nload x\nneg\nmod\n"},
+		{"+x", "load x\n"},
+		// Arguments used more than once are evaluated once
+		{"twice(y + 1)", "load y\nconst 1\nadd\nstore #0\ntemp #0\ntemp #0\nadd\n"},
+		{"twice(y) * twice(2)", "load y\nload y\nadd\nconst 4\nmul\n"},
+	} {
+		prog, err := calc.Compile(tc.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.expr, err)
+		}
+		if got := prog.String(); got != tc.code {
+			t.Fatalf("%q: expected\n%sgot\n%s", tc.expr, tc.code, got)
+		}
+	}
+}
+
+func TestProgramRun(t *testing.T) {
+	calc := NewCalculator()
+	if _, err := calc.Eval("discounted(p, pct) = p * (1 - pct/100)"); err != nil {
+		t.Fatal(err)
+	}
+	const rule = "discounted(price, discount) * qty + max(shipping, 5) - 2^-1"
+	prog, err := calc.Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars := prog.Vars(); !slices.Equal(vars, []string{"price", "discount", "qty", "shipping"}) {
+		t.Fatalf("expected the variables in order of use, got %v", vars)
+	}
+
+	// The same as assigning the variables and evaluating the rule
+	for _, values := range [][]float64{{20, 10, 3, 2}, {9.99, 0, 1, 7.5}, {100, 50, 0, 0}} {
+		for i, name := range prog.Vars() {
+			calc.vars[name] = values[i]
+		}
+		expected, err := calc.Eval(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := prog.Run(values)
+		if err != nil || res != expected {
+			t.Fatalf("%v: expected %v, got %v %v", values, expected, res, err)
+		}
+		if res, err := prog.Eval(calc.vars); err != nil || res != expected {
+			t.Fatalf("%v: expected %v from Eval, got %v %v", values, expected, res, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		expr   string
+		values []float64
+		err    string
+	}{
+		{"1 / x", []float64{0}, "position 2: division by zero"},
+		{"2 + sqrt(x)", []float64{-1}, "position 4: sqrt: square root of a negative number"},
+		{"x + y", []float64{1}, "expected 2 variables"},
+	} {
+		prog, err := Compile(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := prog.Run(tc.values); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("%q: expected error %q, got %v", tc.expr, tc.err, err)
+		}
+	}
+	if _, err := prog.Eval(map[string]float64{"price": 1}); err == nil {
+		t.Fatal("expected an error for unset variables")
+	}
+}
+
+// Inlining must not repeat the code of arguments, nested calls of x + x used to double it at each level
+func TestCompileNestedCalls(t *testing.T) {
+	calc := NewCalculator()
+	if _, err := calc.Eval("d(x) = x + x"); err != nil {
+		t.Fatal(err)
+	}
+	expr := strings.Repeat("d(", 22) + "x" + strings.Repeat(")", 22)
+	prog, err := calc.Compile(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(prog.code); n > 100 {
+		t.Fatalf("expected code linear in the nesting, got %d instructions", n)
+	}
+	calc.vars["x"] = 3
+	expected, err := calc.Eval(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := prog.Run([]float64{3}); err != nil || res != expected {
+		t.Fatalf("expected %v, got %v %v", expected, res, err)
+	}
+
+	// Functions calling others twice still double, up to a bound
+	if _, err := calc.Eval("f0(x) = x + 1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		if _, err := calc.Eval(fmt.Sprintf("f%d(x) = f%d(x) + f%d(x)", i, i-1, i-1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := calc.Compile("f20(x)"); err == nil || !strings.Contains(err.Error(), "too large to compile") {
+		t.Fatalf("expected the expansion to be bounded, got %v", err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	calc := NewCalculator()
+	for _, line := range []string{"loop(x) = loop(x)", "inv(x) = 1 / x"} {
+		if _, err := calc.Eval(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		expr string
+		err  string
+	}{
+		{"2 * (1 / 0)", "position 7: division by zero"},
+		{"x + inv(0)", "position 4: division by zero"},
+		{"sqrt(-4) * x", "square root of a negative number"},
+		{"loop(x)", "recursive functions can't be compiled"},
+		{"f(x)", "undefined function f"},
+		{"sin(x, 1)", "sin takes 1 argument, got 2"},
+		{"x +", "expected a number"},
+	} {
+		if _, err := calc.Compile(tc.expr); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("%q: expected error %q, got %v", tc.expr, tc.err, err)
+		}
+	}
+}
+
+// The same pricing rule evaluated by calculate, which parses it every time, by walking
+// a parsed tree and by the compiled program
+func BenchmarkPricingRule(b *testing.B) {
+	const numeric = "19.99 * (1 - 15/100) * 3 + max(4.5, 5) - 2^-1"
+	const rule = "price * (1 - discount/100) * qty + max(shipping, 5) - 2^-1"
+	benchmarkRule(b, numeric, rule, []float64{19.99, 15, 3, 4.5})
+}
+
+// A rule within reach of the exercise's original recursive solution, integers with + - and
+// parentheses, evaluated by it and by the calculator
+func BenchmarkSumRule(b *testing.B) {
+	const numeric = "1999 - (15 - 3) + (45 + 5) - 1"
+	const rule = "price - (discount - qty) + (shipping + 5) - 1"
+	b.Run("recursive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if res := calculateRecursive(numeric); res != 2036 {
+				b.Fatalf("expected 2036, got %d", res)
+			}
+		}
+	})
+	benchmarkRule(b, numeric, rule, []float64{1999, 15, 3, 45})
+}
+
+// benchmarkRule evaluates numeric with calculate, and rule, which is numeric with the values
+// of its variables in order, by walking its parsed tree and by its compiled program
+func benchmarkRule(b *testing.B, numeric, rule string, values []float64) {
+	b.Run("calculate", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := calculate(numeric); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("tree", func(b *testing.B) {
+		n, err := parse(rule)
+		if err != nil {
+			b.Fatal(err)
+		}
+		prog, err := Compile(rule)
+		if err != nil {
+			b.Fatal(err)
+		}
+		calc := NewCalculator()
+		for i, name := range prog.Vars() {
+			calc.vars[name] = values[i]
+		}
+		s := &scope{calc: calc}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.eval(n); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("bytecode", func(b *testing.B) {
+		prog, err := Compile(rule)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := prog.Run(values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -2,9 +2,18 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "repl" {
+		if err := repl(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	a := myPow(4, 16)
 	fmt.Println("Main", a)
 }
@@ -0,0 +1,118 @@
+package main
+
+// Interactive scratch calculator: go run ./algorithms/leetcode repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const replHelp = `expressions:  1 + 2*3, (1 - -2) ^ 2, 7 % 4, sqrt(2), max(1, 2, 3)
+assignments:  x = 3*4
+functions:    f(x, y) = x^2 + y     then f(2, 1)
+builtins:     sin cos tan abs exp ln sqrt floor ceil round pow min max, constants pi e
+commands:     :vars  :funcs  :history  !! (repeat last)  !n (repeat nth)  :help  :quit`
+
+// repl reads lines from r and writes their results to w until :quit or the end of r
+func repl(r io.Reader, w io.Writer) error {
+	calc := NewCalculator()
+	var history []string
+	scanner := bufio.NewScanner(r)
+	prompt := "> "
+	for fmt.Fprint(w, prompt); scanner.Scan(); fmt.Fprint(w, prompt) {
+		line := strings.TrimSpace(scanner.Text())
+		// Where line starts on screen: after the prompt and the spaces typed before it
+		indent := len(prompt) + len(scanner.Text()) - len(strings.TrimLeft(scanner.Text(), " \t"))
+		// !! and !n run a line of the history again
+		if strings.HasPrefix(line, "!") {
+			recalled, err := recall(history, line)
+			if err != nil {
+				fmt.Fprintln(w, err)
+				continue
+			}
+			// Echoed on a line of its own
+			fmt.Fprintln(w, recalled)
+			line, indent = recalled, 0
+		}
+
+		switch line {
+		case "":
+			continue
+		case ":quit", ":q":
+			return nil
+		case ":help":
+			fmt.Fprintln(w, replHelp)
+			continue
+		case ":vars":
+			for _, name := range sortedKeys(calc.vars) {
+				fmt.Fprintf(w, "%s = %s\n", name, formatNumber(calc.vars[name]))
+			}
+			continue
+		case ":funcs":
+			for _, name := range sortedKeys(calc.funcs) {
+				fmt.Fprintln(w, calc.funcs[name].source)
+			}
+			continue
+		case ":history":
+			for i, h := range history {
+				fmt.Fprintf(w, "%d  %s\n", i+1, h)
+			}
+			continue
+		}
+		history = append(history, line)
+
+		st, err := parseStatement(line)
+		if err == nil {
+			var v float64
+			if v, err = calc.exec(st, line); err == nil {
+				if st.isFunc {
+					fmt.Fprintf(w, "defined %s\n", st.name)
+				} else {
+					fmt.Fprintln(w, formatNumber(v))
+				}
+				continue
+			}
+		}
+		// Point at the error under the line as shown
+		var calcErr *CalcError
+		if errors.As(err, &calcErr) {
+			fmt.Fprintf(w, "%s^\n", strings.Repeat(" ", indent+calcErr.Pos))
+		}
+		fmt.Fprintln(w, "error:", err)
+	}
+	fmt.Fprintln(w)
+	return scanner.Err()
+}
+
+// recall returns the line of history that !! (the last) or !n (the nth) refers to
+func recall(history []string, ref string) (string, error) {
+	if ref == "!!" {
+		if len(history) == 0 {
+			return "", errors.New("no history yet")
+		}
+		return history[len(history)-1], nil
+	}
+	n, err := strconv.Atoi(ref[1:])
+	if err != nil || n < 1 || n > len(history) {
+		return "", fmt.Errorf("no line %s in the history, see :history", ref[1:])
+	}
+	return history[n-1], nil
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -1,34 +1,65 @@
 package main
 
 import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go-learn/fiber/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// In-memory database and ID counter
-var (
-	db     = make(map[int]string)
-	mu     sync.Mutex // Mutex for concurrent safety
-	nextID = 1        // Auto-increment ID
-)
+// Name of the tracer of the items API
+const tracerName = "go-learn/fiber"
+
+// store is the in-memory database behind the items API, every field is guarded by mu
+type store struct {
+	db      map[int]string
+	mu      sync.Mutex   // Mutex for concurrent safety
+	nextID  int          // Auto-increment ID
+	index   *searchIndex // Full-text index over db values
+	deleted map[int]tombstone
+	history map[int][]revision
+}
 
-// Handler to get all items
-func getItems(c *fiber.Ctx) error {
-	// return *c.JSON(db) - can be as well
-	return c.JSON(db)
+func newStore() *store {
+	return &store{
+		db:      make(map[int]string),
+		nextID:  1,
+		index:   newSearchIndex(),
+		deleted: make(map[int]tombstone),
+		history: make(map[int][]revision),
+	}
+}
+
+// Handler to get all items, or the deleted ones with ?deleted=true
+func (s *store) getItems(c *fiber.Ctx) error {
+	// Hold the lock while encoding, c.JSON reads the map
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.QueryBool("deleted") {
+		return c.JSON(s.deleted)
+	}
+	// return *c.JSON(s.db) - can be as well
+	return c.JSON(s.db)
 }
 
 // Handler to get a specific item by ID
-func getItem(c *fiber.Ctx) error {
+func (s *store) getItem(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid ID")
 	}
-	mu.Lock()
-	item, exists := db[id]
-	mu.Unlock()
+	s.mu.Lock()
+	item, exists := s.db[id]
+	s.mu.Unlock()
 	if !exists {
 		return c.Status(fiber.StatusNotFound).SendString("Item not found")
 	}
@@ -36,7 +67,7 @@ func getItem(c *fiber.Ctx) error {
 }
 
 // Handler to add a new item with auto-increment ID
-func addItem(c *fiber.Ctx) error {
+func (s *store) addItem(c *fiber.Ctx) error {
 	type Request struct {
 		Value string `json:"value"` // The part inside backticks (json:"value") is a struct tag. This tells Go how to handle JSON serialization and deserialization.
 	}
@@ -45,28 +76,77 @@ func addItem(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid request")
 	}
 
-	mu.Lock()
-	id := nextID
-	nextID++
-	db[id] = req.Value
-	mu.Unlock()
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.db[id] = req.Value
+	s.index.add(id, req.Value)
+	s.record(id, actionCreated, req.Value)
+	s.mu.Unlock()
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": id, "value": req.Value})
 }
 
-// Handler to delete an item by ID
-func deleteItem(c *fiber.Ctx) error {
+// Handler to replace the value of an existing item
+func (s *store) updateItem(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid ID")
+	}
+	type Request struct {
+		Value string `json:"value"`
+	}
+	req := new(Request)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid request")
+	}
+
+	s.mu.Lock()
+	old, exists := s.db[id]
+	if exists {
+		s.db[id] = req.Value
+		s.index.update(id, old, req.Value)
+		s.record(id, actionUpdated, req.Value)
+	}
+	s.mu.Unlock()
+
+	if !exists {
+		return c.Status(fiber.StatusNotFound).SendString("Item not found")
+	}
+	return c.JSON(fiber.Map{"id": id, "value": req.Value})
+}
+
+// Handler to search items by words in their value, best matches first
+func (s *store) searchItems(c *fiber.Ctx) error {
+	q := c.Query("q")
+	if q == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Missing query")
+	}
+	s.mu.Lock()
+	hits := s.index.search(q, s.db)
+	s.mu.Unlock()
+	if hits == nil {
+		hits = []searchHit{}
+	}
+	return c.JSON(hits)
+}
+
+// Handler to delete an item by ID, it stays restorable until purged
+func (s *store) deleteItem(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid ID")
 	}
 
-	mu.Lock()
-	_, exists := db[id]
+	s.mu.Lock()
+	item, exists := s.db[id]
 	if exists {
-		delete(db, id)
+		delete(s.db, id)
+		s.index.remove(id, item)
+		s.deleted[id] = tombstone{Value: item, DeletedAt: time.Now().UTC()}
+		s.record(id, actionDeleted, item)
 	}
-	mu.Unlock()
+	s.mu.Unlock()
 
 	if !exists {
 		return c.Status(fiber.StatusNotFound).SendString("Item not found")
@@ -75,15 +155,59 @@ func deleteItem(c *fiber.Ctx) error {
 	return c.SendString("Item deleted")
 }
 
-func main() {
+// newApp wires the middleware and routes of the items API around the given store
+func newApp(s *store, logger *slog.Logger, tracer trace.Tracer) *fiber.App {
 	app := fiber.New()
 
+	// Middleware: request IDs, trace spans, structured access logs and latency metrics
+	m := newMetrics()
+	app.Use(newRequestID(), tracing.New(tracer), accessLog(logger), m.middleware())
+
 	// Routes
-	app.Get("/items", getItems)
-	app.Get("/items/:id", getItem)
-	app.Post("/items", addItem)
-	app.Delete("/items/:id", deleteItem)
+	app.Get("/metrics", m.handler)
+	app.Get("/items", s.getItems)
+	app.Get("/items/search", s.searchItems) // must be registered before /items/:id
+	app.Get("/items/:id", s.getItem)
+	app.Post("/items", s.addItem)
+	app.Put("/items/:id", s.updateItem)
+	app.Delete("/items/:id", s.deleteItem)
+	app.Post("/items/:id/restore", s.restoreItem)
+	app.Get("/items/:id/history", s.getItemHistory)
+
+	return app
+}
+
+func main() {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	// TRACE_OUT=stdout or a file path exports the spans of the requests
+	tp, shutdown, err := tracing.Setup(os.Getenv("TRACE_OUT"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := shutdown(context.Background()); err != nil {
+			logger.Error("tracing", "error", err)
+		}
+	}()
+
+	s := newStore()
+	app := newApp(s, logger, tp.Tracer(tracerName))
+
+	// Purge deleted items past the retention window in the background
+	done := make(chan struct{})
+	defer close(done)
+	s.startPurger(done)
+
+	// SIGINT and SIGTERM stop the server, so the spans not exported yet are flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		app.Shutdown()
+	}()
 
 	// Start server
-	app.Listen(":3000")
+	if err := app.Listen(":3000"); err != nil {
+		logger.Error("listen", "error", err)
+	}
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var routeCases = []struct {
+	name     string
+	method   string
+	path     string
+	body     string
+	status   int
+	contains string
+}{
+	{"list items", fiber.MethodGet, "/items", "", fiber.StatusOK, `"1":"first item"`},
+	{"list deleted items", fiber.MethodGet, "/items?deleted=true", "", fiber.StatusOK, `{}`},
+	{"get item", fiber.MethodGet, "/items/2", "", fiber.StatusOK, `{"id":2,"value":"second item"}`},
+	{"get missing item", fiber.MethodGet, "/items/42", "", fiber.StatusNotFound, "Item not found"},
+	{"get invalid id", fiber.MethodGet, "/items/abc", "", fiber.StatusBadRequest, "Invalid ID"},
+	{"add item", fiber.MethodPost, "/items", `{"value":"third"}`, fiber.StatusCreated, `{"id":3,"value":"third"}`},
+	{"add invalid body", fiber.MethodPost, "/items", `{"value":`, fiber.StatusBadRequest, "Invalid request"},
+	{"update item", fiber.MethodPut, "/items/1", `{"value":"changed"}`, fiber.StatusOK, `{"id":1,"value":"changed"}`},
+	{"update missing item", fiber.MethodPut, "/items/42", `{"value":"x"}`, fiber.StatusNotFound, "Item not found"},
+	{"update invalid id", fiber.MethodPut, "/items/abc", `{"value":"x"}`, fiber.StatusBadRequest, "Invalid ID"},
+	{"delete item", fiber.MethodDelete, "/items/1", "", fiber.StatusOK, "Item deleted"},
+	{"delete missing item", fiber.MethodDelete, "/items/42", "", fiber.StatusNotFound, "Item not found"},
+	{"delete invalid id", fiber.MethodDelete, "/items/abc", "", fiber.StatusBadRequest, "Invalid ID"},
+	{"restore item not deleted", fiber.MethodPost, "/items/1/restore", "", fiber.StatusNotFound, "Deleted item not found"},
+	{"restore invalid id", fiber.MethodPost, "/items/abc/restore", "", fiber.StatusBadRequest, "Invalid ID"},
+	{"history", fiber.MethodGet, "/items/1/history", "", fiber.StatusOK, `"action":"created"`},
+	{"history of missing item", fiber.MethodGet, "/items/42/history", "", fiber.StatusNotFound, "Item not found"},
+	{"search", fiber.MethodGet, "/items/search?q=second", "", fiber.StatusOK, `<mark>second</mark>`},
+	{"search without query", fiber.MethodGet, "/items/search", "", fiber.StatusBadRequest, "Missing query"},
+	{"search without matches", fiber.MethodGet, "/items/search?q=nothing", "", fiber.StatusOK, `[]`},
+	{"metrics", fiber.MethodGet, "/metrics", "", fiber.StatusOK, "# TYPE http_request_duration_seconds histogram"},
+	{"unknown route", fiber.MethodGet, "/nope", "", fiber.StatusNotFound, ""},
+}
+
+func TestRoutes(t *testing.T) {
+	for _, tc := range routeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newTestApp(t, nil)
+			a.seed("first item", "second item")
+
+			status, body := a.do(tc.method, tc.path, tc.body)
+			if status != tc.status {
+				t.Fatalf("expected status %d, got %d (%s)", tc.status, status, body)
+			}
+			// encoding/json escapes < and >
+			body = strings.NewReplacer(`\u003c`, "<", `\u003e`, ">").Replace(body)
+			if !strings.Contains(body, tc.contains) {
+				t.Fatalf("expected body to contain %q, got %q", tc.contains, body)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	a := newTestApp(t, nil)
+
+	req := httptest.NewRequest(fiber.MethodGet, "/items", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "abc-123")
+	resp, err := a.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get(fiber.HeaderXRequestID); got != "abc-123" {
+		t.Fatalf("expected propagated request ID %q, got %q", "abc-123", got)
+	}
+
+	resp, err = a.app.Test(httptest.NewRequest(fiber.MethodGet, "/items", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get(fiber.HeaderXRequestID) == "" {
+		t.Fatal("expected a generated request ID")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	a := newTestApp(t, nil)
+
+	// The caller's trace, as another service would send it
+	const traceID, callerSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(fiber.MethodGet, "/items/42", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+callerSpan+"-01")
+	if _, err := a.app.Test(req, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := a.spans.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	s := spans[0]
+	if s.Name() != "GET /items/:id" {
+		t.Fatalf("expected the span to be named after the route, got %q", s.Name())
+	}
+	if s.SpanContext().TraceID().String() != traceID || s.Parent().SpanID().String() != callerSpan {
+		t.Fatalf("expected a child of %s in trace %s, got parent %s in trace %s",
+			callerSpan, traceID, s.Parent().SpanID(), s.SpanContext().TraceID())
+	}
+	var status int64
+	for _, attr := range s.Attributes() {
+		if attr.Key == "http.response.status_code" {
+			status = attr.Value.AsInt64()
+		}
+	}
+	if status != fiber.StatusNotFound {
+		t.Fatalf("expected status %d on the span, got %d", fiber.StatusNotFound, status)
+	}
+}
+
+func TestDeleteRestoreHistory(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.seed("hello world")
+
+	a.do(fiber.MethodPut, "/items/1", `{"value":"hello again"}`)
+	a.do(fiber.MethodDelete, "/items/1", "")
+
+	if status, _ := a.do(fiber.MethodGet, "/items/1", ""); status != fiber.StatusNotFound {
+		t.Fatalf("expected deleted item to be gone, got %d", status)
+	}
+	if _, body := a.do(fiber.MethodGet, "/items/search?q=hello", ""); body != "[]" {
+		t.Fatalf("expected deleted item to be out of the index, got %s", body)
+	}
+	if _, body := a.do(fiber.MethodGet, "/items?deleted=true", ""); !strings.Contains(body, `"value":"hello again"`) {
+		t.Fatalf("expected tombstone, got %s", body)
+	}
+
+	if status, _ := a.do(fiber.MethodPost, "/items/1/restore", ""); status != fiber.StatusOK {
+		t.Fatalf("expected restore to succeed, got %d", status)
+	}
+	if _, body := a.do(fiber.MethodGet, "/items/1", ""); body != `{"id":1,"value":"hello again"}` {
+		t.Fatalf("unexpected restored item %s", body)
+	}
+
+	a.store.mu.Lock()
+	revs := a.store.history[1]
+	a.store.mu.Unlock()
+	actions := make([]string, len(revs))
+	for i, r := range revs {
+		actions[i] = r.Action
+	}
+	expected := "created,updated,deleted,restored"
+	if got := strings.Join(actions, ","); got != expected {
+		t.Fatalf("expected history %s, got %s", expected, got)
+	}
+}
+
+func TestSearchSnippetEscapesHTML(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.seed(`say <script>alert('second')</script> & second`)
+
+	_, body := a.do(fiber.MethodGet, "/items/search?q=second", "")
+	var hits []searchHit
+	if err := json.Unmarshal([]byte(body), &hits); err != nil || len(hits) != 1 {
+		t.Fatalf("expected 1 hit, got %s (%v)", body, err)
+	}
+	expected := `say &lt;script&gt;alert(&#39;<mark>second</mark>&#39;)&lt;/script&gt; &amp; <mark>second</mark>`
+	if hits[0].Snippet != expected {
+		t.Fatalf("expected snippet %q, got %q", expected, hits[0].Snippet)
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	a := newTestApp(t, nil)
+	a.seed("old", "recent")
+	a.do(fiber.MethodDelete, "/items/1", "")
+	a.do(fiber.MethodDelete, "/items/2", "")
+
+	a.store.mu.Lock()
+	t1 := a.store.deleted[1]
+	t1.DeletedAt = t1.DeletedAt.Add(-retention)
+	a.store.deleted[1] = t1
+	a.store.mu.Unlock()
+
+	if purged := a.store.purgeDeleted(time.Now()); purged != 1 {
+		t.Fatalf("expected 1 purged item, got %d", purged)
+	}
+	if status, _ := a.do(fiber.MethodPost, "/items/1/restore", ""); status != fiber.StatusNotFound {
+		t.Fatalf("expected purged item to be unrestorable, got %d", status)
+	}
+	if status, _ := a.do(fiber.MethodGet, "/items/1/history", ""); status != fiber.StatusNotFound {
+		t.Fatalf("expected purged item history to be gone, got %d", status)
+	}
+	if status, _ := a.do(fiber.MethodPost, "/items/2/restore", ""); status != fiber.StatusOK {
+		t.Fatalf("expected recent item to be restorable, got %d", status)
+	}
+}
+
+// TestConcurrentAccess is meant to be run with -race, it exercises every handler touching the store at once
+func TestConcurrentAccess(t *testing.T) {
+	a := newTestApp(t, nil)
+	const workers = 8
+	const perWorker = 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				status, body := a.serve(fiber.MethodPost, "/items", fmt.Sprintf(`{"value":"worker %d item %d"}`, w, i))
+				if status != fiber.StatusCreated {
+					t.Errorf("add: unexpected status %d (%s)", status, body)
+					return
+				}
+				// IDs are handed out concurrently, so deletes of other workers' items may race with their creation
+				for _, r := range [][2]string{
+					{fiber.MethodGet, "/items"},
+					{fiber.MethodGet, "/items/search?q=worker"},
+					{fiber.MethodDelete, fmt.Sprintf("/items/%d", w*perWorker+i+1)},
+					{fiber.MethodGet, "/items?deleted=true"},
+				} {
+					a.serve(r[0], r[1], "")
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	a.store.mu.Lock()
+	defer a.store.mu.Unlock()
+	if total := len(a.store.db) + len(a.store.deleted); total != workers*perWorker {
+		t.Fatalf("expected %d items in total, got %d", workers*perWorker, total)
+	}
+	if a.store.nextID != workers*perWorker+1 {
+		t.Fatalf("expected nextID %d, got %d", workers*perWorker+1, a.store.nextID)
+	}
+}
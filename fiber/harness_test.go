@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testApp is an in-process items API backed by its own store
+type testApp struct {
+	t       *testing.T
+	app     *fiber.App
+	handler fasthttp.RequestHandler
+	store   *store
+	spans   *tracetest.SpanRecorder // Ended spans of the requests
+}
+
+// newTestApp builds the app around s, or a fresh store when s is nil, with logging discarded
+// and spans recorded
+func newTestApp(t *testing.T, s *store) *testApp {
+	t.Helper()
+	if s == nil {
+		s = newStore()
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	app := newApp(s, logger, tp.Tracer(tracerName))
+	return &testApp{t: t, app: app, handler: app.Handler(), store: s, spans: rec}
+}
+
+// serve runs a request straight through the app handler and returns the status code and body.
+// app.Test takes the app mutex on every call, which orders concurrent requests for the race
+// detector and hides unsynchronized store access, so concurrency tests go through here instead.
+func (a *testApp) serve(method, path, body string) (int, string) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	if body != "" {
+		ctx.Request.Header.SetContentType(fiber.MIMEApplicationJSON)
+		ctx.Request.SetBodyString(body)
+	}
+	a.handler(&ctx)
+	return ctx.Response.StatusCode(), string(ctx.Response.Body())
+}
+
+// do sends a request through app.Test and returns the status code and body
+func (a *testApp) do(method, path, body string) (int, string) {
+	a.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	resp, err := a.app.Test(req, -1)
+	if err != nil {
+		a.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		a.t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// seed adds the given values through the API, a fresh store assigns them IDs 1..n in order
+func (a *testApp) seed(values ...string) {
+	for _, v := range values {
+		a.do(fiber.MethodPost, "/items", `{"value":"`+v+`"}`)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Actions recorded in an item's history
+const (
+	actionCreated  = "created"
+	actionUpdated  = "updated"
+	actionDeleted  = "deleted"
+	actionRestored = "restored"
+)
+
+// How long deleted items can be restored, and how often expired ones are purged
+const (
+	retention     = 7 * 24 * time.Hour
+	purgeInterval = time.Hour
+)
+
+// tombstone keeps a deleted item around until it is restored or purged
+type tombstone struct {
+	Value     string    `json:"value"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// revision is one entry in an item's history
+type revision struct {
+	Version int       `json:"version"`
+	Action  string    `json:"action"`
+	Value   string    `json:"value"`
+	At      time.Time `json:"at"`
+}
+
+// record appends a revision to the item's history, the caller must hold mu
+func (s *store) record(id int, action, value string) {
+	s.history[id] = append(s.history[id], revision{
+		Version: len(s.history[id]) + 1,
+		Action:  action,
+		Value:   value,
+		At:      time.Now().UTC(),
+	})
+}
+
+// Handler to restore a deleted item under its original ID
+func (s *store) restoreItem(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid ID")
+	}
+
+	s.mu.Lock()
+	t, exists := s.deleted[id]
+	if exists {
+		delete(s.deleted, id)
+		s.db[id] = t.Value
+		s.index.add(id, t.Value)
+		s.record(id, actionRestored, t.Value)
+	}
+	s.mu.Unlock()
+
+	if !exists {
+		return c.Status(fiber.StatusNotFound).SendString("Deleted item not found")
+	}
+	return c.JSON(fiber.Map{"id": id, "value": t.Value})
+}
+
+// Handler to list every revision of an item, oldest first
+func (s *store) getItemHistory(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid ID")
+	}
+
+	s.mu.Lock()
+	revs := append([]revision(nil), s.history[id]...)
+	s.mu.Unlock()
+
+	if len(revs) == 0 {
+		return c.Status(fiber.StatusNotFound).SendString("Item not found")
+	}
+	return c.JSON(revs)
+}
+
+// purgeDeleted drops tombstones (and their history) older than the retention window
+func (s *store) purgeDeleted(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for id, t := range s.deleted {
+		if now.Sub(t.DeletedAt) >= retention {
+			delete(s.deleted, id)
+			delete(s.history, id)
+			purged++
+		}
+	}
+	return purged
+}
+
+// startPurger runs purgeDeleted in the background until done is closed
+func (s *store) startPurger(done <-chan struct{}) {
+	ticker := time.NewTicker(purgeInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.purgeDeleted(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
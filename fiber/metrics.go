@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Upper bounds (in seconds) of the latency histogram buckets, same as the Prometheus client defaults
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative latency histogram for a single route
+type histogram struct {
+	counts []uint64 // one per bucket, the +Inf bucket is count
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// routeKey identifies a histogram by method and route pattern (not the raw path, to keep cardinality low)
+type routeKey struct {
+	method string
+	route  string
+}
+
+// metrics collects per-route request latencies and renders them in the Prometheus text format
+type metrics struct {
+	mu         sync.Mutex
+	histograms map[routeKey]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{histograms: make(map[routeKey]*histogram)}
+}
+
+func (m *metrics) observe(method, route string, latency time.Duration) {
+	key := routeKey{method: method, route: route}
+	m.mu.Lock()
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.histograms[key] = h
+	}
+	h.observe(latency.Seconds())
+	m.mu.Unlock()
+}
+
+// middleware records the latency of every request under its matched route
+func (m *metrics) middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		// Copy the strings, fiber reuses the underlying buffers after the request
+		m.observe(strings.Clone(c.Method()), strings.Clone(c.Route().Path), time.Since(start))
+		return err
+	}
+}
+
+// handler serves the collected histograms on /metrics
+func (m *metrics) handler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.SendString(m.render())
+}
+
+func (m *metrics) render() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]routeKey, 0, len(m.histograms))
+	for k := range m.histograms {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP http_request_duration_seconds Latency of HTTP requests by route.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, k := range keys {
+		h := m.histograms[k]
+		labels := fmt.Sprintf("method=%q,route=%q", k.method, k.route)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=%q} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	return b.String()
+}
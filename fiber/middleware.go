@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+// requestIDKey is the Locals key under which the requestid middleware stores the ID
+const requestIDKey = "requestid"
+
+// newRequestID assigns an X-Request-ID to every request, reusing the one sent by the client if present
+func newRequestID() fiber.Handler {
+	return requestid.New(requestid.Config{
+		Header:     fiber.HeaderXRequestID,
+		ContextKey: requestIDKey,
+	})
+}
+
+// accessLog emits one structured log line per request once the handler chain has finished
+func accessLog(logger *slog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		if err != nil {
+			// Let the error handler write the response so the logged status matches what the client sees
+			if herr := c.App().ErrorHandler(c, err); herr != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		logger.LogAttrs(c.UserContext(), slog.LevelInfo, "request",
+			slog.Any("request_id", c.Locals(requestIDKey)),
+			slog.String("method", c.Method()),
+			slog.String("route", c.Route().Path),
+			slog.String("path", c.Path()),
+			slog.Int("status", c.Response().StatusCode()),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int("bytes", len(c.Response().Body())),
+		)
+		return nil
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 tuning parameters, the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Number of tokens shown around the first match in a snippet
+const snippetTokens = 12
+
+// token is a normalized word together with its byte span in the original text
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lower-cased words, keeping their positions for highlighting
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWord && start < 0:
+			start = i
+		case !isWord && start >= 0:
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// searchIndex is an inverted index over item values, ranked with BM25.
+// It is not safe for concurrent use, callers hold the store mutex.
+type searchIndex struct {
+	postings map[string]map[int]int // term -> item id -> term frequency
+	docLen   map[int]int            // item id -> number of tokens
+	totalLen int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[int]int),
+		docLen:   make(map[int]int),
+	}
+}
+
+func (idx *searchIndex) add(id int, text string) {
+	tokens := tokenize(text)
+	for _, t := range tokens {
+		docs, ok := idx.postings[t.term]
+		if !ok {
+			docs = make(map[int]int)
+			idx.postings[t.term] = docs
+		}
+		docs[id]++
+	}
+	idx.docLen[id] = len(tokens)
+	idx.totalLen += len(tokens)
+}
+
+func (idx *searchIndex) remove(id int, text string) {
+	for _, t := range tokenize(text) {
+		docs := idx.postings[t.term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, t.term)
+		}
+	}
+	idx.totalLen -= idx.docLen[id]
+	delete(idx.docLen, id)
+}
+
+func (idx *searchIndex) update(id int, oldText, newText string) {
+	idx.remove(id, oldText)
+	idx.add(id, newText)
+}
+
+// searchHit is a single ranked result
+type searchHit struct {
+	ID      int     `json:"id"`
+	Value   string  `json:"value"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+// search ranks the items matching any of the query terms, best first
+func (idx *searchIndex) search(query string, items map[int]string) []searchHit {
+	terms := make(map[string]bool)
+	for _, t := range tokenize(query) {
+		terms[t.term] = true
+	}
+	if len(terms) == 0 || len(idx.docLen) == 0 {
+		return nil
+	}
+
+	n := float64(len(idx.docLen))
+	avgLen := float64(idx.totalLen) / n
+	scores := make(map[int]float64)
+	for term := range terms {
+		docs := idx.postings[term]
+		if len(docs) == 0 {
+			continue
+		}
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, tf := range docs {
+			f := float64(tf)
+			norm := 1 - bm25B + bm25B*float64(idx.docLen[id])/avgLen
+			scores[id] += idf * f * (bm25K1 + 1) / (f + bm25K1*norm)
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		value := items[id]
+		hits = append(hits, searchHit{ID: id, Value: value, Score: score, Snippet: snippet(value, terms)})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
+
+// snippet returns a window of text around the first matching token with matches wrapped in <mark> tags.
+// The text is HTML-escaped, the tags are the only markup in it.
+func snippet(text string, terms map[string]bool) string {
+	tokens := tokenize(text)
+	first := 0
+	for i, t := range tokens {
+		if terms[t.term] {
+			first = i
+			break
+		}
+	}
+	from := max(first-snippetTokens/4, 0)
+	to := min(from+snippetTokens, len(tokens))
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := tokens[from].start
+	for _, t := range tokens[from:to] {
+		b.WriteString(html.EscapeString(text[pos:t.start]))
+		if terms[t.term] {
+			b.WriteString("<mark>" + html.EscapeString(text[t.start:t.end]) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(text[t.start:t.end]))
+		}
+		pos = t.end
+	}
+	if to < len(tokens) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
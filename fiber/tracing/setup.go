@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// NewProvider returns a provider exporting spans as JSON lines to w, e.g. os.Stdout or a file.
+// Shutdown flushes the spans not exported yet.
+func NewProvider(w io.Writer) (*sdktrace.TracerProvider, error) {
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp)), nil
+}
+
+// Setup exports spans to stdout if out is "stdout", or appends them to the file out.
+// Without out spans are not recorded. The returned function flushes them and closes the file.
+func Setup(out string) (trace.TracerProvider, func(context.Context) error, error) {
+	var w io.Writer = os.Stdout
+	var f *os.File
+	switch out {
+	case "":
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case "stdout":
+	default:
+		var err error
+		if f, err = os.OpenFile(out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return nil, nil, fmt.Errorf("trace file: %w", err)
+		}
+		w = f
+	}
+	tp, err := NewProvider(w)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tp, func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
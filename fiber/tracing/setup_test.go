@@ -0,0 +1,37 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	tp, shutdown, err := Setup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tp.Tracer("test").Start(context.Background(), "exported")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported struct {
+		Name        string
+		SpanContext struct{ TraceID string }
+	}
+	if err := json.Unmarshal(data, &exported); err != nil {
+		t.Fatalf("expected a JSON span, got %q: %v", data, err)
+	}
+	if exported.Name != "exported" || exported.SpanContext.TraceID != span.SpanContext().TraceID().String() {
+		t.Fatalf("expected span exported in trace %s, got %+v", span.SpanContext().TraceID(), exported)
+	}
+}
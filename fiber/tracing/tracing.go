@@ -0,0 +1,59 @@
+// Package tracing exports OpenTelemetry spans to stdout or a file, and runs the requests of a Fiber
+// app in server spans continuing the W3C trace context sent by the caller
+package tracing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// W3C trace context, carried in the traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+// carrier reads the trace headers of a Fiber request
+type carrier struct{ c *fiber.Ctx }
+
+func (h carrier) Get(key string) string { return h.c.Get(key) }
+func (h carrier) Set(key, value string) { h.c.Request().Header.Set(key, value) }
+func (h carrier) Keys() []string        { return []string{"traceparent", "tracestate"} }
+
+// New runs Fiber requests in a server span, a child of the span sent in the traceparent header
+// if any. Handlers pass c.UserContext() on, e.g. to NATS publishers, so the trace continues.
+func New(tracer trace.Tracer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Copy the strings, fiber reuses the underlying buffers after the request while spans are
+		// exported later
+		method, path := strings.Clone(c.Method()), strings.Clone(c.Path())
+		ctx := propagator.Extract(c.UserContext(), carrier{c})
+		ctx, span := tracer.Start(ctx, method+" "+path, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", method), attribute.String("url.path", path)))
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		// The route is only known once matched
+		span.SetName(method + " " + c.Route().Path)
+		status := c.Response().StatusCode()
+		if err != nil {
+			var fe *fiber.Error
+			if errors.As(err, &fe) {
+				status = fe.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+			span.RecordError(err)
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+		return err
+	}
+}
@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNew(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	app := fiber.New()
+	app.Use(New(tp.Tracer("test")))
+	var handlerSpan trace.SpanContext
+	app.Get("/users/:id", func(c *fiber.Ctx) error {
+		handlerSpan = trace.SpanContextFromContext(c.UserContext())
+		if c.Params("id") == "0" {
+			return errors.New("broken")
+		}
+		if c.Params("id") == "missing" {
+			return fiber.ErrNotFound
+		}
+		return c.SendString("joe")
+	})
+
+	cases := []struct {
+		path   string
+		status int
+		code   codes.Code
+	}{
+		{"/users/1", fiber.StatusOK, codes.Unset},
+		{"/users/missing", fiber.StatusNotFound, codes.Unset},
+		{"/users/0", fiber.StatusInternalServerError, codes.Error},
+	}
+	for _, tc := range cases {
+		before := len(rec.Ended())
+		if _, err := app.Test(httptest.NewRequest(fiber.MethodGet, tc.path, nil), -1); err != nil {
+			t.Fatal(err)
+		}
+		ended := rec.Ended()
+		if len(ended) != before+1 {
+			t.Fatalf("%s: expected 1 span, got %d", tc.path, len(ended)-before)
+		}
+		s := ended[before]
+		if s.Name() != "GET /users/:id" || s.SpanKind() != trace.SpanKindServer {
+			t.Fatalf("%s: expected a server span named after the route, got %q of kind %v", tc.path, s.Name(), s.SpanKind())
+		}
+		if s.SpanContext().SpanID() != handlerSpan.SpanID() {
+			t.Fatalf("%s: expected the handler to run in the span", tc.path)
+		}
+		var status int64
+		for _, attr := range s.Attributes() {
+			if attr.Key == "http.response.status_code" {
+				status = attr.Value.AsInt64()
+			}
+		}
+		if status != int64(tc.status) || s.Status().Code != tc.code {
+			t.Fatalf("%s: expected status %d and code %v, got %d and %v", tc.path, tc.status, tc.code, status, s.Status().Code)
+		}
+	}
+
+	// The attributes outlive the requests, whose buffers fiber reuses
+	for i, s := range rec.Ended() {
+		for _, attr := range s.Attributes() {
+			if attr.Key == "url.path" && attr.Value.AsString() != cases[i].path {
+				t.Fatalf("expected path %q on span %d, got %q", cases[i].path, i, attr.Value.AsString())
+			}
+		}
+	}
+}
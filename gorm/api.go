@@ -0,0 +1,531 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Pagination defaults for the list endpoints
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// Associations that can be requested with GET /users/:id?include=...
+var userIncludes = map[string]string{
+	"profile": "Profile",
+	"posts":   "Posts",
+	"groups":  "Groups",
+}
+
+// api serves the GORM models over HTTP
+type api struct {
+	repos Repos
+	audit *AuditRepo
+}
+
+// Request headers naming who makes a change and the tenant whose data is accessed
+const (
+	headerActor  = "X-Actor"
+	headerTenant = "X-Tenant-ID"
+)
+
+// Identity is who sends a request
+type Identity struct {
+	Actor  string // Changes are attributed to it in the audit log
+	Tenant uint   // The only tenant whose data the request reads and writes
+}
+
+// IdentityResolver establishes who sends a request from credentials it can verify, e.g. a session
+// cookie or a signed token. Its error is sent as the response, e.g. fiber.ErrUnauthorized.
+type IdentityResolver func(c *fiber.Ctx) (Identity, error)
+
+// TrustedHeaders takes the identity from the X-Actor and X-Tenant-ID headers as is. Any client can
+// send them, reading and writing any tenant's data by changing one header, so this is only a demo
+// stand-in for authentication behind a proxy that authenticates callers and sets the headers itself,
+// replacing theirs. Never expose an API using it directly.
+func TrustedHeaders(c *fiber.Ctx) (Identity, error) {
+	tenant, err := strconv.ParseUint(c.Get(headerTenant), 10, 0)
+	if err != nil || tenant == 0 {
+		return Identity{}, fiber.NewError(fiber.StatusBadRequest, "Invalid or missing "+headerTenant+" header")
+	}
+	return Identity{Actor: c.Get(headerActor), Tenant: uint(tenant)}, nil
+}
+
+// Entities whose audit log can be read with GET /:entity/:id/audit
+var auditEntities = []string{"users", "posts", "groups"}
+
+// newAPI builds the Fiber app exposing users, profiles, posts and groups to the callers identify accepts
+func newAPI(db *gorm.DB, identify IdentityResolver) *fiber.App {
+	a := &api{repos: NewRepos(db), audit: NewAuditRepo(db)}
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+
+	// Every request is scoped to the caller's tenant, and its changes are attributed to the caller
+	// in the audit log
+	app.Use(func(c *fiber.Ctx) error {
+		id, err := identify(c)
+		if err != nil {
+			return err
+		}
+		if id.Tenant == 0 || id.Tenant == allTenants {
+			return fiber.NewError(fiber.StatusForbidden, "No tenant for the caller")
+		}
+		ctx := WithTenant(c.UserContext(), id.Tenant)
+		if id.Actor != "" {
+			ctx = WithActor(ctx, id.Actor)
+		}
+		c.SetUserContext(ctx)
+		return c.Next()
+	})
+
+	app.Get("/users", a.listUsers)
+	app.Post("/users", a.createUser)
+	app.Get("/users/:id", a.getUser)
+	app.Put("/users/:id", a.updateUser)
+	app.Delete("/users/:id", a.deleteUser)
+
+	app.Get("/users/:id/profile", a.getProfile)
+	app.Put("/users/:id/profile", a.saveProfile)
+	app.Delete("/users/:id/profile", a.deleteProfile)
+
+	app.Get("/feed", a.feed)
+	app.Get("/posts", a.listPosts)
+	app.Post("/posts", a.createPost)
+	app.Get("/posts/:id", a.getPost)
+	app.Put("/posts/:id", a.updatePost)
+	app.Delete("/posts/:id", a.deletePost)
+
+	app.Get("/groups", a.listGroups)
+	app.Post("/groups", a.createGroup)
+	app.Get("/groups/:id", a.getGroup)
+	app.Put("/groups/:id", a.updateGroup)
+	app.Delete("/groups/:id", a.deleteGroup)
+	app.Post("/groups/:id/members", a.addMember)
+	app.Delete("/groups/:id/members/:userId", a.removeMember)
+
+	for _, entity := range auditEntities {
+		app.Get("/"+entity+"/:id/audit", a.listAudit(entity))
+	}
+
+	return app
+}
+
+// errorHandler maps repository errors to HTTP status codes
+func errorHandler(c *fiber.Ctx, err error) error {
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &fe):
+		return c.Status(fe.Code).JSON(fiber.Map{"error": fe.Message})
+	case errors.Is(err, ErrInvalidCursor):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrConflict):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, ErrInvalidReference), errors.Is(err, ErrTenantMismatch):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "internal error"})
+	}
+}
+
+// pageResponse is the envelope of every list endpoint
+type pageResponse struct {
+	Items   any   `json:"items"`
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Total   int64 `json:"total"`
+}
+
+// parsePage reads ?page= (1-based) and ?per_page=
+func parsePage(c *fiber.Ctx) (Page, int, int, error) {
+	page := c.QueryInt("page", 1)
+	perPage := c.QueryInt("per_page", defaultPerPage)
+	if page < 1 || perPage < 1 || perPage > maxPerPage {
+		return Page{}, 0, 0, fiber.NewError(fiber.StatusBadRequest, "Invalid pagination")
+	}
+	return Page{Limit: perPage, Offset: (page - 1) * perPage}, page, perPage, nil
+}
+
+// paramID parses a positive numeric route parameter
+func paramID(c *fiber.Ctx, name string) (uint, error) {
+	id, err := strconv.ParseUint(c.Params(name), 10, 0)
+	if err != nil || id == 0 {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "Invalid ID")
+	}
+	return uint(id), nil
+}
+
+// parseBody decodes the JSON request body into req
+func parseBody(c *fiber.Ctx, req any) error {
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request")
+	}
+	return nil
+}
+
+type userRequest struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Version uint   `json:"version"` // Version the client read, required on update
+}
+
+func (a *api) listUsers(c *fiber.Ctx) error {
+	p, page, perPage, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	users, total, err := a.repos.Users.List(c.UserContext(), p)
+	if err != nil {
+		return err
+	}
+	return c.JSON(pageResponse{Items: users, Page: page, PerPage: perPage, Total: total})
+}
+
+func (a *api) createUser(c *fiber.Ctx) error {
+	var req userRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if req.Email == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
+	}
+	u := &User{Name: req.Name, Email: req.Email}
+	if err := a.repos.Users.Create(c.UserContext(), u); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(u)
+}
+
+func (a *api) getUser(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var preload []string
+	if include := c.Query("include"); include != "" {
+		for _, name := range strings.Split(include, ",") {
+			assoc, ok := userIncludes[strings.TrimSpace(name)]
+			if !ok {
+				return fiber.NewError(fiber.StatusBadRequest, "Unknown include "+strconv.Quote(name))
+			}
+			preload = append(preload, assoc)
+		}
+	}
+	u, err := a.repos.Users.Get(c.UserContext(), id, preload...)
+	if err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+func (a *api) updateUser(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var req userRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if req.Email == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Email is required")
+	}
+	if req.Version == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Version is required")
+	}
+	u := &User{ID: id, Name: req.Name, Email: req.Email, Version: req.Version}
+	if err := a.repos.Users.Update(c.UserContext(), u); err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+func (a *api) deleteUser(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := a.repos.Users.Delete(c.UserContext(), id); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (a *api) getProfile(c *fiber.Ctx) error {
+	userID, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	p, err := a.repos.Profiles.GetByUser(c.UserContext(), userID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(p)
+}
+
+func (a *api) saveProfile(c *fiber.Ctx) error {
+	userID, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Bio string `json:"bio"`
+	}
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	p := &Profile{UserID: userID, Bio: req.Bio}
+	if err := a.repos.Profiles.Save(c.UserContext(), p); err != nil {
+		// The user is part of the URL here, so a missing one is a 404 rather than a bad reference
+		if errors.Is(err, ErrInvalidReference) {
+			return fiber.NewError(fiber.StatusNotFound, "User not found")
+		}
+		return err
+	}
+	return c.JSON(p)
+}
+
+func (a *api) deleteProfile(c *fiber.Ctx) error {
+	userID, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := a.repos.Profiles.DeleteByUser(c.UserContext(), userID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type postRequest struct {
+	UserID  uint   `json:"user_id"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Version uint   `json:"version"`
+}
+
+func (a *api) listPosts(c *fiber.Ctx) error {
+	p, page, perPage, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	userID := c.QueryInt("user_id", 0)
+	if userID < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid user_id")
+	}
+	posts, total, err := a.repos.Posts.List(c.UserContext(), uint(userID), p)
+	if err != nil {
+		return err
+	}
+	return c.JSON(pageResponse{Items: posts, Page: page, PerPage: perPage, Total: total})
+}
+
+// feed lists posts across users, newest first, with ?cursor= from the previous page's next_cursor
+func (a *api) feed(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", defaultPerPage)
+	authorID := c.QueryInt("author_id", 0)
+	groupID := c.QueryInt("group_id", 0)
+	if limit < 1 || limit > maxPerPage {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid limit")
+	}
+	if authorID < 0 || groupID < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid author_id or group_id")
+	}
+	feed, err := a.repos.Posts.Feed(c.UserContext(), FeedQuery{
+		AuthorID: uint(authorID),
+		GroupID:  uint(groupID),
+		Title:    c.Query("title"),
+		Cursor:   c.Query("cursor"),
+		Limit:    limit,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(feed)
+}
+
+func (a *api) createPost(c *fiber.Ctx) error {
+	var req postRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	p := &Post{UserID: req.UserID, Title: req.Title, Body: req.Body}
+	if err := a.repos.Posts.Create(c.UserContext(), p); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(p)
+}
+
+func (a *api) getPost(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	p, err := a.repos.Posts.Get(c.UserContext(), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(p)
+}
+
+func (a *api) updatePost(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var req postRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if req.Version == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Version is required")
+	}
+	p := &Post{ID: id, UserID: req.UserID, Title: req.Title, Body: req.Body, Version: req.Version}
+	if err := a.repos.Posts.Update(c.UserContext(), p); err != nil {
+		return err
+	}
+	return c.JSON(p)
+}
+
+func (a *api) deletePost(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := a.repos.Posts.Delete(c.UserContext(), id); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type groupRequest struct {
+	Name    string `json:"name"`
+	Version uint   `json:"version"`
+}
+
+func (a *api) listGroups(c *fiber.Ctx) error {
+	p, page, perPage, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+	groups, total, err := a.repos.Groups.List(c.UserContext(), p)
+	if err != nil {
+		return err
+	}
+	return c.JSON(pageResponse{Items: groups, Page: page, PerPage: perPage, Total: total})
+}
+
+func (a *api) createGroup(c *fiber.Ctx) error {
+	var req groupRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if req.Name == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Name is required")
+	}
+	g := &Group{Name: req.Name}
+	if err := a.repos.Groups.Create(c.UserContext(), g); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(g)
+}
+
+func (a *api) getGroup(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	g, err := a.repos.Groups.Get(c.UserContext(), id, c.Query("include") == "users")
+	if err != nil {
+		return err
+	}
+	return c.JSON(g)
+}
+
+func (a *api) updateGroup(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var req groupRequest
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if req.Name == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Name is required")
+	}
+	if req.Version == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Version is required")
+	}
+	g := &Group{ID: id, Name: req.Name, Version: req.Version}
+	if err := a.repos.Groups.Update(c.UserContext(), g); err != nil {
+		return err
+	}
+	return c.JSON(g)
+}
+
+func (a *api) deleteGroup(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err := a.repos.Groups.Delete(c.UserContext(), id); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (a *api) addMember(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	var req struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := parseBody(c, &req); err != nil {
+		return err
+	}
+	if err := a.repos.Groups.AddMember(c.UserContext(), id, req.UserID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (a *api) removeMember(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	userID, err := paramID(c, "userId")
+	if err != nil {
+		return err
+	}
+	if err := a.repos.Groups.RemoveMember(c.UserContext(), id, userID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// listAudit serves the audit log of one entity, newest first
+func (a *api) listAudit(entity string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := paramID(c, "id")
+		if err != nil {
+			return err
+		}
+		p, page, perPage, err := parsePage(c)
+		if err != nil {
+			return err
+		}
+		logs, total, err := a.audit.List(c.UserContext(), entity, id, p)
+		if err != nil {
+			return err
+		}
+		return c.JSON(pageResponse{Items: logs, Page: page, PerPage: perPage, Total: total})
+	}
+}
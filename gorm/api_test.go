@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiRequest sends a request as tenant 1 through app.Test and returns the status code and body
+func apiRequest(t *testing.T, app *fiber.App, method, path, body string) (int, string) {
+	t.Helper()
+	return tenantRequest(t, app, "1", method, path, body)
+}
+
+// tenantRequest sends a request with the given X-Tenant-ID header, omitted if empty
+func tenantRequest(t *testing.T, app *fiber.App, tenant, method, path, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(headerActor, "tester")
+	if tenant != "" {
+		req.Header.Set(headerTenant, tenant)
+	}
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+var apiCases = []struct {
+	name     string
+	method   string
+	path     string
+	body     string
+	status   int
+	contains string
+}{
+	{"list users", fiber.MethodGet, "/users", "", fiber.StatusOK, `"total":2`},
+	{"list users paginated", fiber.MethodGet, "/users?page=2&per_page=1", "", fiber.StatusOK, `"items":[{"id":2,"name":"Bob"`},
+	{"invalid pagination", fiber.MethodGet, "/users?per_page=1000", "", fiber.StatusBadRequest, "Invalid pagination"},
+	{"create user", fiber.MethodPost, "/users", `{"name":"Carol","email":"carol@example.com"}`, fiber.StatusCreated, `"id":3`},
+	{"create user duplicate email", fiber.MethodPost, "/users", `{"name":"A","email":"alice@example.com"}`, fiber.StatusConflict, "already exists"},
+	{"create user without email", fiber.MethodPost, "/users", `{"name":"A"}`, fiber.StatusBadRequest, "Email is required"},
+	{"get user", fiber.MethodGet, "/users/1", "", fiber.StatusOK, `{"id":1,"name":"Alice","email":"alice@example.com","version":1}`},
+	{"get user with includes", fiber.MethodGet, "/users/1?include=posts,profile,groups", "", fiber.StatusOK, `"groups":[{"id":1,"name":"Developers","version":1}]`},
+	{"get user unknown include", fiber.MethodGet, "/users/1?include=friends", "", fiber.StatusBadRequest, "Unknown include"},
+	{"get missing user", fiber.MethodGet, "/users/42", "", fiber.StatusNotFound, "not found"},
+	{"get user invalid id", fiber.MethodGet, "/users/abc", "", fiber.StatusBadRequest, "Invalid ID"},
+	{"update user", fiber.MethodPut, "/users/2", `{"name":"Robert","email":"bob@example.com","version":1}`, fiber.StatusOK, `"name":"Robert","email":"bob@example.com","version":2`},
+	{"update user duplicate email", fiber.MethodPut, "/users/2", `{"name":"Bob","email":"alice@example.com","version":1}`, fiber.StatusConflict, "already exists"},
+	{"update user stale version", fiber.MethodPut, "/users/2", `{"name":"Bob","email":"bob@example.com","version":7}`, fiber.StatusConflict, "modified concurrently"},
+	{"update user without version", fiber.MethodPut, "/users/2", `{"name":"Bob","email":"bob@example.com"}`, fiber.StatusBadRequest, "Version is required"},
+	{"update missing user", fiber.MethodPut, "/users/42", `{"name":"Bob","email":"bob@example.com","version":1}`, fiber.StatusNotFound, "not found"},
+	{"delete user", fiber.MethodDelete, "/users/2", "", fiber.StatusNoContent, ""},
+	{"delete missing user", fiber.MethodDelete, "/users/42", "", fiber.StatusNotFound, "not found"},
+	{"get profile", fiber.MethodGet, "/users/1/profile", "", fiber.StatusOK, `"bio":"Developer"`},
+	{"save profile", fiber.MethodPut, "/users/2/profile", `{"bio":"Scientist"}`, fiber.StatusOK, `"user_id":2,"bio":"Scientist"`},
+	{"save profile of missing user", fiber.MethodPut, "/users/42/profile", `{"bio":"x"}`, fiber.StatusNotFound, "User not found"},
+	{"delete profile", fiber.MethodDelete, "/users/1/profile", "", fiber.StatusNoContent, ""},
+	{"list posts of user", fiber.MethodGet, "/posts?user_id=1", "", fiber.StatusOK, `"total":1`},
+	{"create post", fiber.MethodPost, "/posts", `{"user_id":2,"title":"New"}`, fiber.StatusCreated, `"title":"New"`},
+	{"create post for missing user", fiber.MethodPost, "/posts", `{"user_id":42,"title":"New"}`, fiber.StatusUnprocessableEntity, "does not exist"},
+	{"get post", fiber.MethodGet, "/posts/1", "", fiber.StatusOK, `"title":"Golang 101"`},
+	{"update post", fiber.MethodPut, "/posts/1", `{"user_id":1,"title":"Go 102","version":1}`, fiber.StatusOK, `"title":"Go 102"`},
+	{"update post stale version", fiber.MethodPut, "/posts/1", `{"user_id":1,"title":"Go 102","version":2}`, fiber.StatusConflict, "modified concurrently"},
+	{"update post for missing user", fiber.MethodPut, "/posts/1", `{"user_id":42,"title":"x","version":1}`, fiber.StatusUnprocessableEntity, "does not exist"},
+	{"delete post", fiber.MethodDelete, "/posts/1", "", fiber.StatusNoContent, ""},
+	{"feed", fiber.MethodGet, "/feed?group_id=1&title=golang", "", fiber.StatusOK, `"title":"Golang 101"`},
+	{"feed includes authors", fiber.MethodGet, "/feed", "", fiber.StatusOK, `"author":{"id":1,"name":"Alice"`},
+	{"feed invalid cursor", fiber.MethodGet, "/feed?cursor=abc", "", fiber.StatusBadRequest, "invalid cursor"},
+	{"feed invalid limit", fiber.MethodGet, "/feed?limit=0", "", fiber.StatusBadRequest, "Invalid limit"},
+	{"list groups", fiber.MethodGet, "/groups", "", fiber.StatusOK, `"total":1`},
+	{"create group", fiber.MethodPost, "/groups", `{"name":"Ops"}`, fiber.StatusCreated, `"name":"Ops"`},
+	{"create group duplicate name", fiber.MethodPost, "/groups", `{"name":"Developers"}`, fiber.StatusConflict, "already exists"},
+	{"get group with users", fiber.MethodGet, "/groups/1?include=users", "", fiber.StatusOK, `"users":[{"id":1`},
+	{"rename group", fiber.MethodPut, "/groups/1", `{"name":"Devs","version":1}`, fiber.StatusOK, `"name":"Devs","version":2`},
+	{"rename group stale version", fiber.MethodPut, "/groups/1", `{"name":"Devs","version":2}`, fiber.StatusConflict, "modified concurrently"},
+	{"user audit log", fiber.MethodGet, "/users/1/audit", "", fiber.StatusOK, `"action":"create","actor":"tester"`},
+	{"group audit log", fiber.MethodGet, "/groups/1/audit", "", fiber.StatusOK, `"entity":"groups","entity_id":1`},
+	{"delete group", fiber.MethodDelete, "/groups/1", "", fiber.StatusNoContent, ""},
+	{"add member", fiber.MethodPost, "/groups/1/members", `{"user_id":2}`, fiber.StatusNoContent, ""},
+	{"add missing member", fiber.MethodPost, "/groups/1/members", `{"user_id":42}`, fiber.StatusUnprocessableEntity, "does not exist"},
+	{"add member to missing group", fiber.MethodPost, "/groups/42/members", `{"user_id":1}`, fiber.StatusNotFound, "not found"},
+	{"remove member", fiber.MethodDelete, "/groups/1/members/1", "", fiber.StatusNoContent, ""},
+}
+
+func TestAPI(t *testing.T) {
+	forEachDB(t, testAPI)
+}
+
+func testAPI(t *testing.T, dsn string) {
+	for _, tc := range apiCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newAPI(newTestDB(t, dsn), TrustedHeaders)
+			seedAPI(t, app)
+
+			status, body := apiRequest(t, app, tc.method, tc.path, tc.body)
+			if status != tc.status {
+				t.Fatalf("expected status %d, got %d (%s)", tc.status, status, body)
+			}
+			if !strings.Contains(body, tc.contains) {
+				t.Fatalf("expected body to contain %q, got %q", tc.contains, body)
+			}
+		})
+	}
+}
+
+func TestAPIDeleteUserCascades(t *testing.T) {
+	forEachDB(t, testAPIDeleteUserCascades)
+}
+
+func testAPIDeleteUserCascades(t *testing.T, dsn string) {
+	app := newAPI(newTestDB(t, dsn), TrustedHeaders)
+	seedAPI(t, app)
+
+	apiRequest(t, app, fiber.MethodDelete, "/users/1", "")
+
+	_, body := apiRequest(t, app, fiber.MethodGet, "/posts?user_id=1", "")
+	var page struct {
+		Total int64 `json:"total"`
+	}
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 0 {
+		t.Fatalf("expected the user's posts to be deleted, got %d", page.Total)
+	}
+	if status, _ := apiRequest(t, app, fiber.MethodGet, "/users/1/profile", ""); status != fiber.StatusNotFound {
+		t.Fatalf("expected the user's profile to be deleted, got %d", status)
+	}
+}
+
+func TestAPIIdentity(t *testing.T) {
+	forEachDB(t, testAPIIdentity)
+}
+
+func testAPIIdentity(t *testing.T, dsn string) {
+	// Accepts two tokens, as an authentication middleware would after verifying them
+	db := newTestDB(t, dsn)
+	app := newAPI(db, func(c *fiber.Ctx) (Identity, error) {
+		switch c.Get(fiber.HeaderAuthorization) {
+		case "Bearer alice-token":
+			return Identity{Actor: "alice", Tenant: 1}, nil
+		case "Bearer tenantless-token":
+			return Identity{Actor: "tenantless"}, nil
+		}
+		return Identity{}, fiber.ErrUnauthorized
+	})
+	request := func(token, method, path, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		// Ignored by the resolver, neither the actor nor the tenant can be forged
+		req.Header.Set(headerActor, "mallory")
+		req.Header.Set(headerTenant, "2")
+		if token != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	for _, token := range []string{"", "mallory-token"} {
+		if status, _ := request(token, fiber.MethodPost, "/users", `{"name":"Mallory","email":"mallory@example.com"}`); status != fiber.StatusUnauthorized {
+			t.Fatalf("token %q: expected status %d, got %d", token, fiber.StatusUnauthorized, status)
+		}
+	}
+	if status, body := request("alice-token", fiber.MethodPost, "/users", `{"name":"Alice","email":"alice@example.com"}`); status != fiber.StatusCreated {
+		t.Fatalf("expected status %d, got %d (%s)", fiber.StatusCreated, status, body)
+	}
+	if _, body := request("alice-token", fiber.MethodGet, "/users/1/audit", ""); !strings.Contains(body, `"actor":"alice"`) {
+		t.Fatalf("expected the change to be attributed to alice, got %s", body)
+	}
+	// The user belongs to alice's tenant, not the one of the header
+	if _, err := NewRepos(db).Users.Get(testCtx, 1); err != nil {
+		t.Fatalf("expected the user in tenant 1, got %v", err)
+	}
+	if status, _ := request("tenantless-token", fiber.MethodGet, "/users/1", ""); status != fiber.StatusForbidden {
+		t.Fatalf("expected status %d for a caller without a tenant, got %d", fiber.StatusForbidden, status)
+	}
+}
+
+// seedAPI creates Alice (with a profile, a post and the Developers group) and Bob through the API
+func seedAPI(t *testing.T, app *fiber.App) {
+	t.Helper()
+	for _, r := range []struct{ method, path, body string }{
+		{fiber.MethodPost, "/users", `{"name":"Alice","email":"alice@example.com"}`},
+		{fiber.MethodPost, "/users", `{"name":"Bob","email":"bob@example.com"}`},
+		{fiber.MethodPut, "/users/1/profile", `{"bio":"Developer"}`},
+		{fiber.MethodPost, "/posts", `{"user_id":1,"title":"Golang 101"}`},
+		{fiber.MethodPost, "/groups", `{"name":"Developers"}`},
+		{fiber.MethodPost, "/groups/1/members", `{"user_id":1}`},
+	} {
+		if status, body := apiRequest(t, app, r.method, r.path, r.body); status >= 300 {
+			t.Fatalf("seeding %s %s: %d %s", r.method, r.path, status, body)
+		}
+	}
+}
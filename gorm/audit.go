@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AuditLog records a single create, update or delete of an audited entity
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  uint      `gorm:"not null;index" json:"-"`
+	Entity    string    `gorm:"size:64;index:idx_audit_entity" json:"entity"`
+	EntityID  uint      `gorm:"index:idx_audit_entity" json:"entity_id"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	Changes   string    `json:"changes"` // JSON object of column -> {"before": ..., "after": ...}
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Audit actions
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// Tables whose changes are written to the audit log
+var auditedTables = map[string]bool{
+	"users":  true,
+	"posts":  true,
+	"groups": true,
+}
+
+// Actor recorded when the context does not carry one
+const systemActor = "system"
+
+type actorKey struct{}
+
+// WithActor returns a context whose database changes are attributed to actor in the audit log
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return systemActor
+}
+
+// Key under which the rows as they were before an update or delete are kept on the statement
+const auditBeforeKey = "audit:before"
+
+// registerAudit installs the callbacks writing the audit log, in the same transaction as the change
+func registerAudit(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().After("gorm:create").Register("audit:after_create", auditAfter(auditCreate)),
+		cb.Update().Before("gorm:update").Register("audit:before_update", auditBefore),
+		cb.Update().After("gorm:update").Register("audit:after_update", auditAfter(auditUpdate)),
+		cb.Delete().Before("gorm:delete").Register("audit:before_delete", auditBefore),
+		cb.Delete().After("gorm:delete").Register("audit:after_delete", auditAfter(auditDelete)),
+	} {
+		if err != nil {
+			return fmt.Errorf("register audit callbacks: %w", err)
+		}
+	}
+	return nil
+}
+
+func audited(db *gorm.DB) bool {
+	return db.Error == nil && db.Statement.Schema != nil && auditedTables[db.Statement.Table]
+}
+
+// auditBefore loads the rows an update or delete is about to change
+func auditBefore(db *gorm.DB) {
+	if !audited(db) {
+		return
+	}
+	rows, err := loadRows(db, primaryKeys(db), true)
+	if err != nil {
+		db.AddError(fmt.Errorf("audit: %w", err))
+		return
+	}
+	db.InstanceSet(auditBeforeKey, rows)
+}
+
+// auditAfter compares the affected rows with their previous state and writes one log entry per row
+func auditAfter(action string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		if !audited(db) || db.RowsAffected == 0 {
+			return
+		}
+		var before map[uint]map[string]any
+		if v, ok := db.InstanceGet(auditBeforeKey); ok {
+			before = v.(map[uint]map[string]any)
+		}
+
+		after := map[uint]map[string]any{}
+		if action != auditDelete {
+			ids := primaryKeys(db)
+			for id := range before {
+				ids = append(ids, id)
+			}
+			var err error
+			if after, err = loadRows(db, ids, false); err != nil {
+				db.AddError(fmt.Errorf("audit: %w", err))
+				return
+			}
+		}
+
+		actor := actorFrom(db.Statement.Context)
+		now := time.Now().UTC()
+		var logs []AuditLog
+		for id, changes := range diffRows(before, after) {
+			b, err := json.Marshal(changes)
+			if err != nil {
+				db.AddError(fmt.Errorf("audit: %w", err))
+				return
+			}
+			tenantID, err := rowTenant(before[id], after[id])
+			if err != nil {
+				db.AddError(fmt.Errorf("audit: %w", err))
+				return
+			}
+			logs = append(logs, AuditLog{
+				TenantID: tenantID, Entity: db.Statement.Table, EntityID: id, Action: action,
+				Actor: actor, Changes: string(b), CreatedAt: now,
+			})
+		}
+		if len(logs) == 0 {
+			return
+		}
+		if err := db.Session(&gorm.Session{NewDB: true}).Create(&logs).Error; err != nil {
+			db.AddError(fmt.Errorf("audit: %w", err))
+		}
+	}
+}
+
+// primaryKeys returns the non-zero IDs of the model or slice of models the statement works on
+func primaryKeys(db *gorm.DB) []uint {
+	stmt := db.Statement
+	field := stmt.Schema.PrioritizedPrimaryField
+	if field == nil || !stmt.ReflectValue.IsValid() {
+		return nil
+	}
+	var ids []uint
+	eachModel(db, func(rv reflect.Value) {
+		if v, zero := field.ValueOf(stmt.Context, rv); !zero {
+			if id, ok := v.(uint); ok {
+				ids = append(ids, id)
+			}
+		}
+	})
+	return ids
+}
+
+// loadRows reads the current state of the audited rows, keyed by ID. Rows are selected by ids and,
+// if withWhere is set, by the statement's WHERE clause, so that conditional updates and deletes
+// only log the rows they are going to touch.
+func loadRows(db *gorm.DB, ids []uint, withWhere bool) (map[uint]map[string]any, error) {
+	q := db.Session(&gorm.Session{NewDB: true}).Table(db.Statement.Table)
+	where, hasWhere := db.Statement.Clauses["WHERE"].Expression.(clause.Where)
+	hasWhere = hasWhere && withWhere && len(where.Exprs) > 0
+	if len(ids) == 0 && !hasWhere {
+		return map[uint]map[string]any{}, nil
+	}
+	if hasWhere {
+		q = q.Clauses(clause.Where{Exprs: where.Exprs})
+	}
+	if len(ids) > 0 {
+		q = q.Where("id IN ?", ids)
+	}
+
+	var rows []map[string]any
+	if err := q.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]map[string]any, len(rows))
+	for _, row := range rows {
+		id, err := toUint(row["id"])
+		if err != nil {
+			return nil, err
+		}
+		byID[id] = row
+	}
+	return byID, nil
+}
+
+func toUint(v any) (uint, error) {
+	switch n := v.(type) {
+	case int64:
+		return uint(n), nil
+	case int32:
+		return uint(n), nil
+	case int:
+		return uint(n), nil
+	case uint64:
+		return uint(n), nil
+	case uint32:
+		return uint(n), nil
+	case uint:
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unexpected id type %T", v)
+	}
+}
+
+// rowTenant returns the tenant of an audited row, so that entries written under AllTenants
+// still belong to the tenant of the row
+func rowTenant(rows ...map[string]any) (uint, error) {
+	for _, row := range rows {
+		if v, ok := row["tenant_id"]; ok {
+			return toUint(v)
+		}
+	}
+	return 0, nil
+}
+
+// change is the before and after value of a single column
+type change struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// diffRows returns, for each row, the columns whose value differs between before and after
+func diffRows(before, after map[uint]map[string]any) map[uint]map[string]change {
+	diffs := make(map[uint]map[string]change)
+	for _, rows := range []map[uint]map[string]any{before, after} {
+		for id := range rows {
+			if _, done := diffs[id]; done {
+				continue
+			}
+			changes := make(map[string]change)
+			for col, v := range before[id] {
+				if !reflect.DeepEqual(v, after[id][col]) {
+					changes[col] = change{Before: v, After: after[id][col]}
+				}
+			}
+			for col, v := range after[id] {
+				if _, ok := before[id][col]; !ok {
+					changes[col] = change{Before: nil, After: v}
+				}
+			}
+			if len(changes) > 0 {
+				diffs[id] = changes
+			}
+		}
+	}
+	return diffs
+}
+
+// AuditRepo reads the audit log
+type AuditRepo struct {
+	db *gorm.DB
+}
+
+func NewAuditRepo(db *gorm.DB) *AuditRepo {
+	return &AuditRepo{db: db}
+}
+
+// List returns a page of log entries for an entity (a table name such as "users"), newest first
+func (r *AuditRepo) List(ctx context.Context, entity string, entityID uint, p Page) ([]AuditLog, int64, error) {
+	var logs []AuditLog
+	var total int64
+	db := r.db.WithContext(ctx).Model(&AuditLog{}).Where("entity = ? AND entity_id = ?", entity, entityID)
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, wrapError("count audit logs", err)
+	}
+	if err := paginated(db, p).Order("id DESC").Find(&logs).Error; err != nil {
+		return nil, 0, wrapError(fmt.Sprintf("list audit logs of %s %d", entity, entityID), err)
+	}
+	return logs, total, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestOptimisticLocking(t *testing.T) {
+	forEachDB(t, testOptimisticLocking)
+}
+
+func testOptimisticLocking(t *testing.T, dsn string) {
+	ctx := testCtx
+	r := NewRepos(newTestDB(t, dsn))
+
+	u := &User{Name: "Alice", Email: "alice@example.com"}
+	if err := r.Users.Create(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := r.Users.Get(ctx, u.ID)
+	second, _ := r.Users.Get(ctx, u.ID)
+
+	first.Email = "alice@work.example.com"
+	if err := r.Users.Update(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != 2 {
+		t.Fatalf("expected version 2 after update, got %d", first.Version)
+	}
+
+	second.Name = "Alice Smith"
+	if err := r.Users.Update(ctx, second); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a stale version, got %v", err)
+	}
+	got, _ := r.Users.Get(ctx, u.ID)
+	if got.Name != "Alice" || got.Email != "alice@work.example.com" {
+		t.Fatalf("expected the stale update to be rejected, got %+v", got)
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	forEachDB(t, testAuditTrail)
+}
+
+func testAuditTrail(t *testing.T, dsn string) {
+	db := newTestDB(t, dsn)
+	r := NewRepos(db)
+
+	u := &User{Name: "Alice", Email: "alice@example.com"}
+	if err := r.Users.Create(WithActor(testCtx, "registration"), u); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Posts.Create(testCtx, &Post{UserID: u.ID, Title: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	u.Email = "alice@work.example.com"
+	if err := r.Users.Update(WithActor(testCtx, "admin"), u); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Users.Delete(WithActor(testCtx, "admin"), u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, total, err := NewAuditRepo(db).List(testCtx, "users", u.ID, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 {
+		t.Fatalf("expected 3 audit entries, got %d: %+v", total, logs)
+	}
+	// Newest first
+	for i, expected := range []struct{ action, actor string }{
+		{auditDelete, "admin"},
+		{auditUpdate, "admin"},
+		{auditCreate, "registration"},
+	} {
+		if logs[i].Action != expected.action || logs[i].Actor != expected.actor {
+			t.Fatalf("entry %d: expected %s by %s, got %s by %s", i, expected.action, expected.actor, logs[i].Action, logs[i].Actor)
+		}
+	}
+
+	var changes map[string]change
+	if err := json.Unmarshal([]byte(logs[1].Changes), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if c := changes["email"]; c.Before != "alice@example.com" || c.After != "alice@work.example.com" {
+		t.Fatalf("expected the email change to be recorded, got %+v", changes)
+	}
+	if _, ok := changes["name"]; ok {
+		t.Fatalf("expected unchanged columns to be left out, got %+v", changes)
+	}
+
+	// Posts deleted together with their author are audited as well
+	_, total, err = NewAuditRepo(db).List(testCtx, "posts", 1, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Fatalf("expected create and delete entries for the post, got %d", total)
+	}
+}
+
+func TestAuditRolledBackWithChange(t *testing.T) {
+	forEachDB(t, testAuditRolledBackWithChange)
+}
+
+func testAuditRolledBackWithChange(t *testing.T, dsn string) {
+	ctx := testCtx
+	db := newTestDB(t, dsn)
+
+	err := NewUnitOfWork(db).Do(ctx, func(r Repos) error {
+		if err := r.Users.Create(ctx, &User{Name: "Alice", Email: "alice@example.com"}); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("expected the transaction to fail")
+	}
+	var n int64
+	if err := db.WithContext(ctx).Model(&AuditLog{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected the audit entry to be rolled back with the change, got %d entries", n)
+	}
+}
@@ -1,82 +1,187 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"time"
 
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 // User represents a user entity
 type User struct {
-	ID      uint `gorm:"primaryKey"`
-	Name    string
-	Email   string  `gorm:"unique"`
-	Profile Profile `gorm:"constraint:OnDelete:CASCADE;"`
-	Posts   []Post  `gorm:"constraint:OnDelete:CASCADE;"`
-	Groups  []Group `gorm:"many2many:user_groups;"`
+	ID       uint     `gorm:"primaryKey" json:"id"`
+	TenantID uint     `gorm:"not null;index;uniqueIndex:idx_users_tenant_email" json:"-"` // Set from the context, see WithTenant
+	Name     string   `json:"name"`
+	Email    string   `gorm:"size:255;uniqueIndex:idx_users_tenant_email" json:"email"` // Unique within the tenant
+	Version  uint     `gorm:"not null;default:1" json:"version"`                        // Incremented on every update, for optimistic locking
+	Profile  *Profile `gorm:"constraint:OnDelete:CASCADE;" json:"profile,omitempty"`
+	Posts    []Post   `gorm:"constraint:OnDelete:CASCADE;" json:"posts,omitempty"`
+	Groups   []Group  `gorm:"many2many:user_groups;" json:"groups,omitempty"`
 }
 
 // Profile represents a one-to-one relationship
 type Profile struct {
-	ID     uint `gorm:"primaryKey"`
-	UserID uint `gorm:"unique"`
-	Bio    string
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	TenantID uint   `gorm:"not null;index" json:"-"` // The tenant of the user
+	UserID   uint   `gorm:"unique" json:"user_id"`
+	Bio      string `json:"bio"`
 }
 
 // Post represents a one-to-many relationship
 type Post struct {
-	ID     uint `gorm:"primaryKey"`
-	UserID uint
-	Title  string
-	Body   string
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  uint      `gorm:"not null;index" json:"-"`
+	UserID    uint      `json:"user_id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Version   uint      `gorm:"not null;default:1" json:"version"`
+	CreatedAt time.Time `json:"created_at"` // Sort key of the feed, together with ID
 }
 
 // Group represents a many-to-many relationship
 type Group struct {
-	ID    uint   `gorm:"primaryKey"`
-	Name  string `gorm:"unique"`
-	Users []User `gorm:"many2many:user_groups;"`
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	TenantID uint   `gorm:"not null;index;uniqueIndex:idx_groups_tenant_name" json:"-"`
+	Name     string `gorm:"size:255;uniqueIndex:idx_groups_tenant_name" json:"name"` // Unique within the tenant
+	Version  uint   `gorm:"not null;default:1" json:"version"`
+	Users    []User `gorm:"many2many:user_groups;" json:"users,omitempty"`
+}
+
+// defaultDSN is an in-memory SQLite database. A plain :memory: would give each pooled
+// connection its own empty database, the shared cache makes them all see the same one.
+const defaultDSN = "file:go-learn?mode=memory&cache=shared"
+
+// connect opens the database, with the driver picked from the DSN, without touching the schema
+func connect(dsn string) (*gorm.DB, error) {
+	// TranslateError turns driver specific errors (e.g. unique violations) into gorm errors
+	db, err := gorm.Open(dialector(dsn), &gorm.Config{
+		TranslateError: true,
+		// Timestamps are kept in UTC so that they sort the same as text in SQLite
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if err := registerTenancy(db); err != nil {
+		return nil, err
+	}
+	if err := registerAudit(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDB opens the database and applies any pending migrations
+func openDB(dsn string) (*gorm.DB, error) {
+	db, err := connect(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := NewMigrator(db, migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
 func main() {
+	ctx := context.Background()
+	// DB_DSN selects the database (see dialector), by default an in-memory SQLite one
+	dsn := os.Getenv("DB_DSN")
+
+	// go run ./gorm migrate up|down [steps]|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		// Migrating the throwaway default database would do nothing
+		if dsn == "" {
+			log.Fatal("migrate: set DB_DSN to the database to migrate")
+		}
+		db, err := connect(dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := migrateCommand(ctx, db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if dsn == "" {
+		dsn = defaultDSN
+	}
 	fmt.Println("Start")
-	// Open an in-memory SQLite database
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	db, err := openDB(dsn)
 	if err != nil {
-		panic("failed to connect database")
+		log.Fatal(err)
 	}
 
-	// Auto migrate the schema
-	db.AutoMigrate(&User{}, &Profile{}, &Post{}, &Group{})
+	// go run ./gorm seed [file] loads fixtures (by default the demo data) for tenant 1
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		if err := seedCommand(ctx, db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Create users
-	alice := User{Name: "Alice", Email: "alice@example.com", Profile: Profile{Bio: "Software Developer"}}
-	bob := User{Name: "Bob", Email: "bob@example.com", Profile: Profile{Bio: "Data Scientist"}}
-	db.Create(&alice)
-	db.Create(&bob)
+	// go run ./gorm serve exposes the models over HTTP. The caller and their tenant are taken from
+	// request headers as sent, which is only sound behind an authenticating proxy, see TrustedHeaders.
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		log.Fatal(newAPI(db, TrustedHeaders).Listen(":3000"))
+	}
 
-	// Create posts
-	db.Create(&Post{UserID: alice.ID, Title: "Golang 101", Body: "Introduction to Golang."})
-	db.Create(&Post{UserID: alice.ID, Title: "GORM Guide", Body: "How to use GORM."})
-	db.Create(&Post{UserID: bob.ID, Title: "Data Science Basics", Body: "Understanding machine learning."})
+	if err := run(ctx, db); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// Create groups
-	group1 := Group{Name: "Developers"}
-	group2 := Group{Name: "Data Scientists"}
-	db.Create(&group1)
-	db.Create(&group2)
+func run(ctx context.Context, db *gorm.DB) error {
+	// The demo data belongs to a single tenant
+	ctx = WithTenant(ctx, 1)
+	repos := NewRepos(db)
 
-	// Associate users with groups
-	db.Model(&alice).Association("Groups").Append(&group1)
-	db.Model(&bob).Association("Groups").Append(&group2)
+	// Create users, posts and groups from the seed fixtures
+	f, err := ParseFixtures("seed.yaml", seedFixtures)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Load(ctx, db); err != nil {
+		return err
+	}
 
 	// Read user with profile and posts
-	var user User
-	db.Preload("Profile").Preload("Posts").First(&user, "email = ?", "alice@example.com")
+	user, err := repos.Users.GetByEmail(ctx, "alice@example.com", "Profile", "Posts")
+	if err != nil {
+		return err
+	}
 	fmt.Println("User:", user.Name, "Profile Bio:", user.Profile.Bio, "Posts:", len(user.Posts))
 
 	// Read user groups
-	db.Preload("Groups").First(&user, "email = ?", "alice@example.com")
+	user, err = repos.Users.GetByEmail(ctx, "alice@example.com", "Groups")
+	if err != nil {
+		return err
+	}
 	fmt.Println("User Groups:", user.Groups)
+
+	// Unique emails are reported as ErrDuplicate
+	err = repos.Users.Create(ctx, &User{Name: "Alice again", Email: "alice@example.com"})
+	fmt.Println("Duplicate email:", err, errors.Is(err, ErrDuplicate))
+	return nil
+}
+
+func seedCommand(ctx context.Context, db *gorm.DB, args []string) error {
+	f, err := ParseFixtures("seed.yaml", seedFixtures)
+	if len(args) > 0 {
+		f, err = ReadFixtures(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	seeded, err := f.Load(WithTenant(ctx, 1), db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Seeded %d users and %d groups\n", len(seeded.Users), len(seeded.Groups))
+	return nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCursor is returned for a feed cursor that was not produced by Feed
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FeedQuery selects a page of the posts feed, newest first. Zero fields do not filter.
+type FeedQuery struct {
+	AuthorID uint
+	GroupID  uint   // Only posts of members of the group
+	Title    string // Case-insensitive substring of the title
+	Cursor   string // NextCursor of the previous page, empty for the first page
+	Limit    int    // Page size, defaultPerPage if 0
+}
+
+// FeedItem is a post together with its author
+type FeedItem struct {
+	Post
+	Author *User `json:"author"`
+}
+
+// Feed is a page of the posts feed
+type Feed struct {
+	Items      []FeedItem `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"` // Empty on the last page
+}
+
+// feedCursor is the sort key of the last post of a page
+type feedCursor struct {
+	createdAt time.Time
+	id        uint
+}
+
+func (c feedCursor) String() string {
+	raw := c.createdAt.UTC().Format(time.RFC3339Nano) + "," + strconv.FormatUint(uint64(c.id), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseFeedCursor(s string) (feedCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return feedCursor{}, ErrInvalidCursor
+	}
+	at, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return feedCursor{}, ErrInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return feedCursor{}, ErrInvalidCursor
+	}
+	n, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		return feedCursor{}, ErrInvalidCursor
+	}
+	return feedCursor{createdAt: createdAt.UTC(), id: uint(n)}, nil
+}
+
+// scopes returns the filters of the query as GORM scopes
+func (q FeedQuery) scopes() ([]func(*gorm.DB) *gorm.DB, error) {
+	var scopes []func(*gorm.DB) *gorm.DB
+	if q.AuthorID != 0 {
+		scopes = append(scopes, func(db *gorm.DB) *gorm.DB {
+			return db.Where("posts.user_id = ?", q.AuthorID)
+		})
+	}
+	if q.GroupID != 0 {
+		scopes = append(scopes, func(db *gorm.DB) *gorm.DB {
+			return db.Where("posts.user_id IN (SELECT user_id FROM user_groups WHERE group_id = ?)", q.GroupID)
+		})
+	}
+	if q.Title != "" {
+		// ! escapes LIKE wildcards in the search text, the same way in every dialect
+		pattern := "%" + strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(q.Title)) + "%"
+		scopes = append(scopes, func(db *gorm.DB) *gorm.DB {
+			return db.Where("LOWER(posts.title) LIKE ? ESCAPE '!'", pattern)
+		})
+	}
+	if q.Cursor != "" {
+		c, err := parseFeedCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		// Keyset pagination: strictly after the last post of the previous page. The row value
+		// comparison, unlike the equivalent OR, lets the database seek in idx_posts_feed.
+		scopes = append(scopes, func(db *gorm.DB) *gorm.DB {
+			return db.Where("(posts.created_at, posts.id) < (?, ?)", c.createdAt, c.id)
+		})
+	}
+	return scopes, nil
+}
+
+// Feed returns a page of posts across users, newest first, with their authors loaded in one query
+func (r *PostRepo) Feed(ctx context.Context, q FeedQuery) (*Feed, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultPerPage
+	}
+	scopes, err := q.scopes()
+	if err != nil {
+		return nil, fmt.Errorf("feed: %w", err)
+	}
+	db := r.db.WithContext(ctx)
+
+	// One extra row tells whether there is a next page
+	var posts []Post
+	err = db.Scopes(scopes...).Order("posts.created_at DESC, posts.id DESC").Limit(q.Limit + 1).Find(&posts).Error
+	if err != nil {
+		return nil, wrapError("feed", err)
+	}
+	feed := &Feed{Items: make([]FeedItem, 0, len(posts))}
+	if len(posts) > q.Limit {
+		posts = posts[:q.Limit]
+		last := posts[len(posts)-1]
+		feed.NextCursor = feedCursor{createdAt: last.CreatedAt, id: last.ID}.String()
+	}
+
+	authors := make(map[uint]*User)
+	var ids []uint
+	for _, p := range posts {
+		if _, ok := authors[p.UserID]; !ok {
+			authors[p.UserID] = nil
+			ids = append(ids, p.UserID)
+		}
+	}
+	if len(ids) > 0 {
+		var users []User
+		if err := db.Find(&users, ids).Error; err != nil {
+			return nil, wrapError("feed authors", err)
+		}
+		for i := range users {
+			authors[users[i].ID] = &users[i]
+		}
+	}
+	for _, p := range posts {
+		feed.Items = append(feed.Items, FeedItem{Post: p, Author: authors[p.UserID]})
+	}
+	return feed, nil
+}
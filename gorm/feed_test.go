@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// seedFeed creates n posts round-robin for the users, three at a time sharing a timestamp
+func seedFeed(tb testing.TB, db *gorm.DB, users []*User, n int) {
+	tb.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	posts := make([]Post, n)
+	for i := range posts {
+		posts[i] = Post{
+			UserID:    users[i%len(users)].ID,
+			Title:     fmt.Sprintf("Post %d", i),
+			CreatedAt: base.Add(time.Duration(i/3) * time.Second),
+		}
+	}
+	if err := db.WithContext(testCtx).CreateInBatches(posts, 1000).Error; err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	forEachDB(t, testFeed)
+}
+
+func testFeed(t *testing.T, dsn string) {
+	ctx := testCtx
+	db := newTestDB(t, dsn)
+	seeded := loadFixtures(t, db)
+	alice, bob := seeded.Users["alice@example.com"], seeded.Users["bob@example.com"]
+	seedFeed(t, db, []*User{alice, bob}, 25)
+	r := NewPostRepo(db)
+
+	var queries int
+	if err := db.Callback().Query().After("gorm:query").Register("test:count", func(*gorm.DB) { queries++ }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Walking the feed returns every post once, newest first
+	var all []FeedItem
+	q := FeedQuery{Limit: 4}
+	for page := 0; ; page++ {
+		queries = 0
+		feed, err := r.Feed(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queries != 2 {
+			t.Fatalf("expected posts and authors to be loaded in 2 queries, got %d", queries)
+		}
+		all = append(all, feed.Items...)
+		if feed.NextCursor == "" {
+			break
+		}
+		if page > 10 {
+			t.Fatal("expected the feed to end")
+		}
+		q.Cursor = feed.NextCursor
+	}
+	if len(all) != 28 {
+		t.Fatalf("expected 28 posts, got %d", len(all))
+	}
+	for i, item := range all {
+		if item.Author == nil || item.Author.ID != item.UserID {
+			t.Fatalf("expected post %d to have its author, got %+v", item.ID, item.Author)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := all[i-1]
+		if item.CreatedAt.After(prev.CreatedAt) || item.CreatedAt.Equal(prev.CreatedAt) && item.ID >= prev.ID {
+			t.Fatalf("expected newest first, got post %d after %d", item.ID, prev.ID)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		q    FeedQuery
+		want int
+	}{
+		{"author", FeedQuery{AuthorID: bob.ID, Limit: 100}, 13},
+		{"group", FeedQuery{GroupID: seeded.Groups["Developers"].ID, Limit: 100}, 15},
+		{"title", FeedQuery{Title: "post 1", Limit: 100}, 11},
+		{"title is not a pattern", FeedQuery{Title: "%", Limit: 100}, 0},
+		{"author and title", FeedQuery{AuthorID: alice.ID, Title: "GORM", Limit: 100}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			feed, err := r.Feed(ctx, tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(feed.Items) != tc.want || feed.NextCursor != "" {
+				t.Fatalf("expected %d posts on a single page, got %d", tc.want, len(feed.Items))
+			}
+		})
+	}
+
+	for _, cursor := range []string{"!", "bm90LWEtY3Vyc29y", feedCursor{}.String()[:4]} {
+		if _, err := r.Feed(ctx, FeedQuery{Cursor: cursor}); !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("expected ErrInvalidCursor for %q, got %v", cursor, err)
+		}
+	}
+}
+
+// BenchmarkFeed pages through 100k posts. The offset variants show what keyset pagination avoids.
+func BenchmarkFeed(b *testing.B) {
+	ctx := testCtx
+	db := newTestDB(b, "")
+	users := make([]*User, 100)
+	for i := range users {
+		users[i] = &User{Name: fmt.Sprintf("User %d", i), Email: fmt.Sprintf("user%d@example.com", i)}
+	}
+	if err := db.WithContext(ctx).CreateInBatches(users, 100).Error; err != nil {
+		b.Fatal(err)
+	}
+	seedFeed(b, db, users, 100_000)
+	g := &Group{Name: "Benchmarkers"}
+	if err := NewGroupRepo(db).Create(ctx, g); err != nil {
+		b.Fatal(err)
+	}
+	for _, u := range users[:10] {
+		if err := NewGroupRepo(db).AddMember(ctx, g.ID, u.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+	r := NewPostRepo(db)
+
+	// Cursor of the 50_000th post, to compare deep keyset and offset pages
+	var deep []Post
+	if err := db.WithContext(ctx).Order("created_at DESC, id DESC").Offset(49_999).Limit(1).Find(&deep).Error; err != nil {
+		b.Fatal(err)
+	}
+	deepCursor := feedCursor{createdAt: deep[0].CreatedAt, id: deep[0].ID}.String()
+
+	for _, bc := range []struct {
+		name string
+		q    FeedQuery
+	}{
+		{"first page", FeedQuery{Limit: 20}},
+		{"deep page", FeedQuery{Cursor: deepCursor, Limit: 20}},
+		{"author", FeedQuery{AuthorID: users[42].ID, Limit: 20}},
+		{"group", FeedQuery{GroupID: g.ID, Limit: 20}},
+		{"title", FeedQuery{Title: "post 9999", Limit: 20}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := r.Feed(ctx, bc.q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("deep page with offset", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var posts []Post
+			err := db.WithContext(ctx).Order("created_at DESC, id DESC").Offset(50_000).Limit(20).Find(&posts).Error
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFeedCursorRoundTrip(t *testing.T) {
+	c := feedCursor{createdAt: time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC), id: 42}
+	got, err := parseFeedCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.createdAt.Equal(c.createdAt) || got.id != c.id {
+		t.Fatalf("expected %+v, got %+v", c, got)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Fixtures describe seed data. Records refer to each other by natural key: users by email, groups by name.
+type Fixtures struct {
+	Users  []UserFixture  `yaml:"users" json:"users"`
+	Posts  []PostFixture  `yaml:"posts" json:"posts"`
+	Groups []GroupFixture `yaml:"groups" json:"groups"`
+}
+
+type UserFixture struct {
+	Name  string `yaml:"name" json:"name"`
+	Email string `yaml:"email" json:"email"`
+	Bio   string `yaml:"bio" json:"bio"` // Profile bio, no profile is created if empty
+}
+
+type PostFixture struct {
+	Author string `yaml:"author" json:"author"` // Email of the user
+	Title  string `yaml:"title" json:"title"`
+	Body   string `yaml:"body" json:"body"`
+}
+
+type GroupFixture struct {
+	Name    string   `yaml:"name" json:"name"`
+	Members []string `yaml:"members" json:"members"` // Emails of the users
+}
+
+// Seed data loaded by the demo
+//
+//go:embed fixtures/seed.yaml
+var seedFixtures []byte
+
+// ParseFixtures decodes fixtures, as JSON if name ends in .json and as YAML otherwise
+func ParseFixtures(name string, data []byte) (*Fixtures, error) {
+	var f Fixtures
+	var err error
+	if filepath.Ext(name) == ".json" {
+		err = json.Unmarshal(data, &f)
+	} else {
+		err = yaml.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse fixtures %s: %w", name, err)
+	}
+	return &f, nil
+}
+
+// ReadFixtures parses a YAML or JSON fixture file
+func ReadFixtures(path string) (*Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFixtures(path, data)
+}
+
+// Seeded holds the records of loaded fixtures by natural key
+type Seeded struct {
+	Users  map[string]*User  // By email
+	Groups map[string]*Group // By name
+}
+
+// Load writes the fixtures in one transaction for the tenant of ctx. Users and groups that already
+// exist are reused and posts are only created if the author has none with the same title, so seeding
+// twice is harmless. References to unknown users fail with ErrInvalidReference.
+func (f *Fixtures) Load(ctx context.Context, db *gorm.DB) (*Seeded, error) {
+	seeded := &Seeded{Users: map[string]*User{}, Groups: map[string]*Group{}}
+	// Looking up records that do not exist yet is expected, don't log it
+	db = db.Session(&gorm.Session{Logger: ignoreNotFound{db.Logger}})
+	err := NewUnitOfWork(db).Do(ctx, func(r Repos) error {
+		for _, uf := range f.Users {
+			u, err := findOrCreate(
+				func() (*User, error) { return r.Users.GetByEmail(ctx, uf.Email) },
+				func(u *User) error { return r.Users.Create(ctx, u) },
+				&User{Name: uf.Name, Email: uf.Email},
+			)
+			if err != nil {
+				return err
+			}
+			if uf.Bio != "" {
+				if err := r.Profiles.Save(ctx, &Profile{UserID: u.ID, Bio: uf.Bio}); err != nil {
+					return err
+				}
+			}
+			seeded.Users[u.Email] = u
+		}
+
+		user := func(email string) (*User, error) {
+			if u, ok := seeded.Users[email]; ok {
+				return u, nil
+			}
+			u, err := r.Users.GetByEmail(ctx, email)
+			if errors.Is(err, ErrNotFound) {
+				return nil, fmt.Errorf("user %q: %w", email, ErrInvalidReference)
+			}
+			if err != nil {
+				return nil, err
+			}
+			seeded.Users[email] = u
+			return u, nil
+		}
+
+		for _, pf := range f.Posts {
+			author, err := user(pf.Author)
+			if err != nil {
+				return fmt.Errorf("post %q: %w", pf.Title, err)
+			}
+			posts, err := r.Posts.ListByUser(ctx, author.ID)
+			if err != nil {
+				return err
+			}
+			if !hasTitle(posts, pf.Title) {
+				if err := r.Posts.Create(ctx, &Post{UserID: author.ID, Title: pf.Title, Body: pf.Body}); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, gf := range f.Groups {
+			g, err := findOrCreate(
+				func() (*Group, error) { return r.Groups.GetByName(ctx, gf.Name) },
+				func(g *Group) error { return r.Groups.Create(ctx, g) },
+				&Group{Name: gf.Name},
+			)
+			if err != nil {
+				return err
+			}
+			for _, email := range gf.Members {
+				u, err := user(email)
+				if err != nil {
+					return fmt.Errorf("group %q: %w", gf.Name, err)
+				}
+				if err := r.Groups.AddMember(ctx, g.ID, u.ID); err != nil {
+					return err
+				}
+			}
+			seeded.Groups[g.Name] = g
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load fixtures: %w", err)
+	}
+	return seeded, nil
+}
+
+// findOrCreate returns the record found by get, or creates and returns fresh if there is none
+func findOrCreate[T any](get func() (*T, error), create func(*T) error, fresh *T) (*T, error) {
+	found, err := get()
+	if err == nil {
+		return found, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := create(fresh); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+func hasTitle(posts []Post, title string) bool {
+	for _, p := range posts {
+		if p.Title == title {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreNotFound is a logger which doesn't report lookups of missing records as errors
+type ignoreNotFound struct {
+	logger.Interface
+}
+
+func (l ignoreNotFound) LogMode(level logger.LogLevel) logger.Interface {
+	return ignoreNotFound{l.Interface.LogMode(level)}
+}
+
+func (l ignoreNotFound) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	l.Interface.Trace(ctx, begin, fc, err)
+}
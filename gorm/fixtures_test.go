@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// loadFixtures seeds the test database with the demo data followed by the given fixture files
+func loadFixtures(t *testing.T, db *gorm.DB, paths ...string) *Seeded {
+	t.Helper()
+	f, err := ParseFixtures("seed.yaml", seedFixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded, err := f.Load(testCtx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		f, err := ReadFixtures(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seeded, err = f.Load(testCtx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return seeded
+}
+
+func TestLoadFixtures(t *testing.T) {
+	forEachDB(t, testLoadFixtures)
+}
+
+func testLoadFixtures(t *testing.T, dsn string) {
+	ctx := testCtx
+	db := newTestDB(t, dsn)
+	seeded := loadFixtures(t, db, "testdata/fixtures.json")
+	r := NewRepos(db)
+
+	// The JSON fixtures refer to Alice and the Developers group of the seed data
+	alice, err := r.Users.GetByEmail(ctx, "alice@example.com", "Profile", "Posts", "Groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Profile.Bio != "Software Developer" || len(alice.Posts) != 3 || len(alice.Groups) != 1 {
+		t.Fatalf("expected Alice with her bio, 3 posts and 1 group, got %+v", alice)
+	}
+	devs, err := r.Groups.Get(ctx, seeded.Groups["Developers"].ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs.Users) != 2 {
+		t.Fatalf("expected Alice and Carol in Developers, got %+v", devs.Users)
+	}
+	ops, err := r.Groups.Get(ctx, seeded.Groups["Ops"].ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops.Users) != 2 {
+		t.Fatalf("expected Carol and Dave in Ops, got %+v", ops.Users)
+	}
+	if _, err := r.Profiles.GetByUser(ctx, seeded.Users["dave@example.com"].ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected no profile for Dave, got %v", err)
+	}
+
+	// Loading the same fixtures again changes nothing
+	loadFixtures(t, db, "testdata/fixtures.json")
+	if _, total, err := r.Users.List(ctx, Page{Limit: 10}); err != nil || total != 4 {
+		t.Fatalf("expected 4 users after reseeding, got %d, %v", total, err)
+	}
+	if posts, err := r.Posts.ListByUser(ctx, alice.ID); err != nil || len(posts) != 3 {
+		t.Fatalf("expected Alice to still have 3 posts, got %d, %v", len(posts), err)
+	}
+}
+
+func TestLoadFixturesUnknownReference(t *testing.T) {
+	forEachDB(t, testLoadFixturesUnknownReference)
+}
+
+func testLoadFixturesUnknownReference(t *testing.T, dsn string) {
+	db := newTestDB(t, dsn)
+	f, err := ParseFixtures("bad.yaml", []byte(`
+users:
+  - name: Erin
+    email: erin@example.com
+groups:
+  - name: Nobody
+    members: [nobody@example.com]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Load(testCtx, db); !errors.Is(err, ErrInvalidReference) {
+		t.Fatalf("expected ErrInvalidReference, got %v", err)
+	}
+	// Nothing is written if a reference cannot be resolved
+	if _, err := NewUserRepo(db).GetByEmail(testCtx, "erin@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the load to be rolled back, got %v", err)
+	}
+}
+
+func TestParseFixturesInvalid(t *testing.T) {
+	for _, name := range []string{"bad.json", "bad.yaml"} {
+		if _, err := ParseFixtures(name, []byte("users: {")); err == nil {
+			t.Fatalf("expected %s to fail to parse", name)
+		}
+	}
+}
+
+// tracingLogger counts the statements it is given and keeps their errors
+type tracingLogger struct {
+	logger.Interface
+	traced *int
+	errs   *[]error
+}
+
+func (l tracingLogger) LogMode(logger.LogLevel) logger.Interface { return l }
+
+func (l tracingLogger) Trace(_ context.Context, _ time.Time, _ func() (string, int64), err error) {
+	*l.traced++
+	if err != nil {
+		*l.errs = append(*l.errs, err)
+	}
+}
+
+// Load logs through the caller's logger, without the expected lookups of missing records
+func TestLoadFixturesLogger(t *testing.T) {
+	forEachDB(t, testLoadFixturesLogger)
+}
+
+func testLoadFixturesLogger(t *testing.T, dsn string) {
+	var traced int
+	var errs []error
+	db := newTestDB(t, dsn)
+	db = db.Session(&gorm.Session{Logger: tracingLogger{Interface: db.Logger, traced: &traced, errs: &errs}})
+	loadFixtures(t, db)
+	if traced == 0 {
+		t.Fatal("expected the statements to be logged by the caller's logger")
+	}
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors logged, got %v", errs)
+	}
+}
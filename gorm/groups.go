@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GroupRepo stores groups and their many-to-many memberships
+type GroupRepo struct {
+	db *gorm.DB
+}
+
+func NewGroupRepo(db *gorm.DB) *GroupRepo {
+	return &GroupRepo{db: db}
+}
+
+// Create inserts the group, it fails with ErrDuplicate if the name is taken
+func (r *GroupRepo) Create(ctx context.Context, g *Group) error {
+	err := r.db.WithContext(ctx).Create(g).Error
+	return wrapError(fmt.Sprintf("create group %q", g.Name), err)
+}
+
+// Get loads a group by ID, with its members if withUsers is set
+func (r *GroupRepo) Get(ctx context.Context, id uint, withUsers bool) (*Group, error) {
+	var g Group
+	db := r.db.WithContext(ctx)
+	if withUsers {
+		db = db.Preload("Users")
+	}
+	if err := db.First(&g, id).Error; err != nil {
+		return nil, wrapError(fmt.Sprintf("get group %d", id), err)
+	}
+	return &g, nil
+}
+
+// List returns a page of groups ordered by ID and the total number of groups
+func (r *GroupRepo) List(ctx context.Context, p Page) ([]Group, int64, error) {
+	var groups []Group
+	var total int64
+	db := r.db.WithContext(ctx).Model(&Group{})
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, wrapError("count groups", err)
+	}
+	if err := paginated(db, p).Order("id").Find(&groups).Error; err != nil {
+		return nil, 0, wrapError("list groups", err)
+	}
+	return groups, total, nil
+}
+
+// Update renames the group if g.Version is still current and increments it.
+// It fails with ErrConflict on a concurrent update and ErrDuplicate if the name is taken.
+func (r *GroupRepo) Update(ctx context.Context, g *Group) error {
+	res := r.db.WithContext(ctx).Model(g).Where("version = ?", g.Version).Updates(map[string]any{
+		"name":    g.Name,
+		"version": gorm.Expr("version + 1"),
+	})
+	if err := checkUpdated(res, &Group{}, g.ID); err != nil {
+		return wrapError(fmt.Sprintf("update group %d", g.ID), err)
+	}
+	g.Version++
+	return nil
+}
+
+// GetByName loads a group by its unique name
+func (r *GroupRepo) GetByName(ctx context.Context, name string) (*Group, error) {
+	var g Group
+	if err := r.db.WithContext(ctx).First(&g, "name = ?", name).Error; err != nil {
+		return nil, wrapError(fmt.Sprintf("get group %q", name), err)
+	}
+	return &g, nil
+}
+
+// AddMember adds the user to the group.
+// It fails with ErrNotFound if the group does not exist and ErrInvalidReference if the user does not.
+func (r *GroupRepo) AddMember(ctx context.Context, groupID, userID uint) error {
+	op := fmt.Sprintf("add user %d to group %d", userID, groupID)
+	db := r.db.WithContext(ctx)
+	var g Group
+	if err := db.First(&g, groupID).Error; err != nil {
+		return wrapError(op, err)
+	}
+	var u User
+	if err := db.First(&u, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = fmt.Errorf("user %d: %w", userID, ErrInvalidReference)
+		}
+		return wrapError(op, err)
+	}
+	return wrapError(op, db.Model(&g).Association("Users").Append(&u))
+}
+
+// RemoveMember removes the user from the group, it is not an error if they were not a member
+func (r *GroupRepo) RemoveMember(ctx context.Context, groupID, userID uint) error {
+	err := r.db.WithContext(ctx).Model(&Group{ID: groupID}).Association("Users").Delete(&User{ID: userID})
+	return wrapError(fmt.Sprintf("remove user %d from group %d", userID, groupID), err)
+}
+
+// Delete removes the group and its memberships
+func (r *GroupRepo) Delete(ctx context.Context, id uint) error {
+	res := r.db.WithContext(ctx).Select(clause.Associations).Delete(&Group{ID: id})
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = gorm.ErrRecordNotFound
+	}
+	return wrapError(fmt.Sprintf("delete group %d", id), res.Error)
+}
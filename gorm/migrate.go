@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is a numbered, reversible schema change.
+// Up and Down run in a transaction and should only rely on types declared inside them,
+// so that later changes to the models do not rewrite history.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// schemaMigration is a row of the schema_migrations table, one per applied migration
+type schemaMigration struct {
+	Version   uint `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationStatus tells whether a migration has been applied, AppliedAt is nil if not
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies and reverts migrations, keeping track of them in schema_migrations
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the given migrations, which are sorted by version
+func NewMigrator(db *gorm.DB, migrations []Migration) *Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{db: db, migrations: sorted}
+}
+
+func (m *Migrator) init(ctx context.Context) error {
+	db := m.db.WithContext(ctx)
+	if db.Migrator().HasTable(&schemaMigration{}) {
+		return nil
+	}
+	if err := db.Migrator().CreateTable(&schemaMigration{}); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[uint]schemaMigration, error) {
+	var rows []schemaMigration
+	if err := m.db.WithContext(ctx).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	applied := make(map[uint]schemaMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// Up applies every pending migration in version order and returns the ones it applied
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		err := m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := mig.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s up: %w", mig.Version, mig.Name, err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns the ones it reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		err := m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := mig.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{Version: mig.Version}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s down: %w", mig.Version, mig.Name, err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// Status lists every known migration in version order along with when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(m.migrations))
+	for i, mig := range m.migrations {
+		status[i].Migration = mig
+		if r, ok := applied[mig.Version]; ok {
+			status[i].AppliedAt = &r.AppliedAt
+		}
+	}
+	return status, nil
+}
+
+// migrateCommand implements the "migrate up|down [steps]|status" subcommands
+func migrateCommand(ctx context.Context, db *gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+	m := NewMigrator(db, migrations)
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx)
+		for _, mig := range done {
+			fmt.Printf("applied  %04d_%s\n", mig.Version, mig.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("nothing to apply")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		done, err := m.Down(ctx, steps)
+		for _, mig := range done {
+			fmt.Printf("reverted %04d_%s\n", mig.Version, mig.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("nothing to revert")
+		}
+		return err
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationsUpDown(t *testing.T) {
+	forEachDB(t, testMigrationsUpDown)
+}
+
+func testMigrationsUpDown(t *testing.T, dsn string) {
+	ctx := testCtx
+	if dsn == "" {
+		dsn = filepath.Join(t.TempDir(), "migrations.db")
+	} else {
+		resetTestDB(t, dsn)
+	}
+	db, err := connect(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMigrator(db, migrations)
+
+	done, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(migrations) {
+		t.Fatalf("expected %d migrations applied, got %d", len(migrations), len(done))
+	}
+	if done, err := m.Up(ctx); err != nil || len(done) != 0 {
+		t.Fatalf("expected a second up to be a no-op, got %v, %v", done, err)
+	}
+
+	// The migrated schema must fit the current models
+	if err := NewUserRepo(db).Create(ctx, &User{Name: "Alice", Email: "alice@example.com", Profile: &Profile{Bio: "Dev"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revert one migration at a time, checking that it and the ones after it can be re-applied and reverted again
+	for i := len(migrations) - 1; i >= 0; i-- {
+		name := migrations[i].Name
+		if done, err := m.Down(ctx, 1); err != nil || len(done) != 1 || done[0].Version != migrations[i].Version {
+			t.Fatalf("down %s: got %v, %v", name, done, err)
+		}
+		pending := len(migrations) - i
+		if done, err := m.Up(ctx); err != nil || len(done) != pending {
+			t.Fatalf("up from %s: expected %d migrations, got %v, %v", name, pending, done, err)
+		}
+		if done, err := m.Down(ctx, pending); err != nil || len(done) != pending {
+			t.Fatalf("down to %s: expected %d migrations, got %v, %v", name, pending, done, err)
+		}
+
+		status, err := m.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, s := range status {
+			if applied := s.AppliedAt != nil; applied != (j < i) {
+				t.Fatalf("after reverting %s: migration %s applied=%v", name, s.Name, applied)
+			}
+		}
+	}
+
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if table != "schema_migrations" && table != "sqlite_sequence" {
+			t.Fatalf("expected every table to be dropped, found %s", table)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// migrations is the schema history, append new versions at the end and never edit applied ones
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users_posts_groups",
+		Up: func(tx *gorm.DB) error {
+			// Snapshots of the models at this version, table names come from the type names
+			type user struct {
+				ID    uint `gorm:"primaryKey"`
+				Name  string
+				Email string `gorm:"unique"`
+			}
+			type profile struct {
+				ID     uint `gorm:"primaryKey"`
+				UserID uint `gorm:"unique"`
+				Bio    string
+				User   user `gorm:"constraint:OnDelete:CASCADE;"`
+			}
+			type post struct {
+				ID     uint `gorm:"primaryKey"`
+				UserID uint
+				Title  string
+				Body   string
+				User   user `gorm:"constraint:OnDelete:CASCADE;"`
+			}
+			type group struct {
+				ID   uint   `gorm:"primaryKey"`
+				Name string `gorm:"unique"`
+			}
+			type userGroup struct {
+				GroupID uint `gorm:"primaryKey"`
+				UserID  uint `gorm:"primaryKey"`
+				Group   group
+				User    user
+			}
+			return tx.Migrator().CreateTable(&user{}, &group{}, &profile{}, &post{}, &userGroup{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("user_groups", "posts", "profiles", "groups", "users")
+		},
+	}, {
+		Version: 2,
+		Name:    "add_versions_and_audit_logs",
+		Up: func(tx *gorm.DB) error {
+			type versioned struct {
+				Version uint `gorm:"not null;default:1"`
+			}
+			for _, table := range []string{"users", "posts", "groups"} {
+				if err := tx.Table(table).Migrator().AddColumn(&versioned{}, "Version"); err != nil {
+					return err
+				}
+			}
+			type auditLog struct {
+				ID        uint   `gorm:"primaryKey"`
+				Entity    string `gorm:"index:idx_audit_entity"`
+				EntityID  uint   `gorm:"index:idx_audit_entity"`
+				Action    string
+				Actor     string
+				Changes   string
+				CreatedAt time.Time
+			}
+			return tx.Migrator().CreateTable(&auditLog{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable("audit_logs"); err != nil {
+				return err
+			}
+			type versioned struct {
+				Version uint
+			}
+			for _, table := range []string{"users", "posts", "groups"} {
+				if err := tx.Table(table).Migrator().DropColumn(&versioned{}, "Version"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, {
+		Version: 3,
+		Name:    "add_tenant_ids",
+		Up: func(tx *gorm.DB) error {
+			// Rows that exist before tenants are introduced belong to tenant 1
+			type tenantScoped struct {
+				TenantID uint `gorm:"not null;default:1"`
+			}
+			for _, table := range []string{"users", "posts", "groups", "audit_logs"} {
+				if err := tx.Table(table).Migrator().AddColumn(&tenantScoped{}, "TenantID"); err != nil {
+					return err
+				}
+				index := "idx_" + table + "_tenant_id"
+				if err := tx.Exec("CREATE INDEX ? ON ? (tenant_id)", clause.Table{Name: index}, clause.Table{Name: table}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type tenantScoped struct {
+				TenantID uint
+			}
+			for _, table := range []string{"users", "posts", "groups", "audit_logs"} {
+				if err := tx.Migrator().DropIndex(table, "idx_"+table+"_tenant_id"); err != nil {
+					return err
+				}
+				if err := tx.Table(table).Migrator().DropColumn(&tenantScoped{}, "TenantID"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, {
+		Version: 4,
+		Name:    "add_post_created_at",
+		Up: func(tx *gorm.DB) error {
+			type post struct {
+				CreatedAt time.Time
+			}
+			if err := tx.Table("posts").Migrator().AddColumn(&post{}, "CreatedAt"); err != nil {
+				return err
+			}
+			// Existing posts get the time of the migration, the feed needs a non-null sort key
+			if err := tx.Exec("UPDATE posts SET created_at = ? WHERE created_at IS NULL", time.Now().UTC()).Error; err != nil {
+				return err
+			}
+			return tx.Exec("CREATE INDEX idx_posts_feed ON posts (tenant_id, created_at, id)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex("posts", "idx_posts_feed"); err != nil {
+				return err
+			}
+			// The SQLite migrator drops a column by recreating the table, which would lose the tenant index
+			return tx.Exec("ALTER TABLE posts DROP COLUMN created_at").Error
+		},
+	}, {
+		Version: 5,
+		Name:    "add_profile_tenant_id",
+		Up: func(tx *gorm.DB) error {
+			type profile struct {
+				TenantID uint `gorm:"not null;default:1"`
+			}
+			if err := tx.Table("profiles").Migrator().AddColumn(&profile{}, "TenantID"); err != nil {
+				return err
+			}
+			// Existing profiles belong to the tenant of their user
+			if err := tx.Exec("UPDATE profiles SET tenant_id = (SELECT users.tenant_id FROM users WHERE users.id = profiles.user_id)").Error; err != nil {
+				return err
+			}
+			return tx.Exec("CREATE INDEX idx_profiles_tenant_id ON profiles (tenant_id)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex("profiles", "idx_profiles_tenant_id"); err != nil {
+				return err
+			}
+			type profile struct {
+				TenantID uint
+			}
+			return tx.Table("profiles").Migrator().DropColumn(&profile{}, "TenantID")
+		},
+	}, {
+		Version: 6,
+		Name:    "unique_per_tenant",
+		Up: func(tx *gorm.DB) error {
+			// Emails and group names are unique within a tenant, not across tenants.
+			// The constraints of migration 1, which the migrators look up on the models.
+			type user struct {
+				Email string `gorm:"size:255;unique"`
+			}
+			type group struct {
+				Name string `gorm:"size:255;unique"`
+			}
+			if err := tx.Migrator().DropConstraint(&user{}, "uni_users_email"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropConstraint(&group{}, "uni_groups_name"); err != nil {
+				return err
+			}
+			for _, idx := range [][3]string{{"idx_users_tenant_email", "users", "email"}, {"idx_groups_tenant_name", "groups", "name"}} {
+				// Quoted as tables, GROUPS is a reserved word in MySQL
+				err := tx.Exec("CREATE UNIQUE INDEX ? ON ? (tenant_id, ?)",
+					clause.Table{Name: idx[0]}, clause.Table{Name: idx[1]}, clause.Column{Name: idx[2]}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return restoreTenantIndexes(tx, "users", "groups")
+		},
+		Down: func(tx *gorm.DB) error {
+			// Fails if two tenants share an email or a group name
+			if err := tx.Migrator().DropIndex("users", "idx_users_tenant_email"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropIndex("groups", "idx_groups_tenant_name"); err != nil {
+				return err
+			}
+			type user struct {
+				Email string `gorm:"size:255;unique"`
+			}
+			type group struct {
+				Name string `gorm:"size:255;unique"`
+			}
+			if err := tx.Migrator().CreateConstraint(&user{}, "uni_users_email"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateConstraint(&group{}, "uni_groups_name"); err != nil {
+				return err
+			}
+			return restoreTenantIndexes(tx, "users", "groups")
+		},
+	}, {
+		Version: 7,
+		Name:    "size_indexed_strings",
+		Up: func(tx *gorm.DB) error {
+			// Indexed strings get the size of the models. They were text on PostgreSQL and VARCHAR(191),
+			// the MySQL driver's default for indexed strings, on MySQL. SQLite ignores sizes.
+			switch tx.Dialector.Name() {
+			case "postgres":
+				return alterColumns(tx, "ALTER TABLE ? ALTER COLUMN ? TYPE ?", "")
+			case "mysql":
+				return alterColumns(tx, "ALTER TABLE ? MODIFY ? ?", "")
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			// Fails on MySQL if a value no longer fits
+			switch tx.Dialector.Name() {
+			case "postgres":
+				return alterColumns(tx, "ALTER TABLE ? ALTER COLUMN ? TYPE ?", "text")
+			case "mysql":
+				return alterColumns(tx, "ALTER TABLE ? MODIFY ? ?", "varchar(191)")
+			}
+			return nil
+		},
+	},
+}
+
+// indexedStrings are the table, column and type of the strings sized by migration 7
+var indexedStrings = [][3]string{
+	{"users", "email", "varchar(255)"}, {"groups", "name", "varchar(255)"}, {"audit_logs", "entity", "varchar(64)"},
+}
+
+// alterColumns runs sql, whose placeholders are the table, the column and its type, on indexedStrings.
+// A non-empty typ replaces the type of every column.
+func alterColumns(tx *gorm.DB, sql string, typ string) error {
+	for _, c := range indexedStrings {
+		if typ != "" {
+			c[2] = typ
+		}
+		if err := tx.Exec(sql, clause.Table{Name: c[0]}, clause.Column{Name: c[1]}, clause.Expr{SQL: c[2]}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreTenantIndexes recreates the tenant_id indexes of migration 3. SQLite can't alter
+// constraints, its migrator copies the table to a new one, which drops the table's indexes.
+func restoreTenantIndexes(tx *gorm.DB, tables ...string) error {
+	for _, table := range tables {
+		index := "idx_" + table + "_tenant_id"
+		if tx.Migrator().HasIndex(table, index) {
+			continue
+		}
+		if err := tx.Exec("CREATE INDEX ? ON ? (tenant_id)", clause.Table{Name: index}, clause.Table{Name: table}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// PostRepo stores the posts written by users
+type PostRepo struct {
+	db *gorm.DB
+}
+
+func NewPostRepo(db *gorm.DB) *PostRepo {
+	return &PostRepo{db: db}
+}
+
+// Create inserts the post, it fails with ErrInvalidReference if the author does not exist
+func (r *PostRepo) Create(ctx context.Context, p *Post) error {
+	op := fmt.Sprintf("create post %q", p.Title)
+	db := r.db.WithContext(ctx)
+	if err := checkAuthor(db, p.UserID); err != nil {
+		return wrapError(op, err)
+	}
+	return wrapError(op, db.Create(p).Error)
+}
+
+func (r *PostRepo) Get(ctx context.Context, id uint) (*Post, error) {
+	var p Post
+	if err := r.db.WithContext(ctx).First(&p, id).Error; err != nil {
+		return nil, wrapError(fmt.Sprintf("get post %d", id), err)
+	}
+	return &p, nil
+}
+
+// List returns a page of posts ordered by ID, only those of userID unless it is 0, and the total count
+func (r *PostRepo) List(ctx context.Context, userID uint, p Page) ([]Post, int64, error) {
+	var posts []Post
+	var total int64
+	db := r.db.WithContext(ctx).Model(&Post{})
+	if userID != 0 {
+		db = db.Where("user_id = ?", userID)
+	}
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, wrapError("count posts", err)
+	}
+	if err := paginated(db, p).Order("id").Find(&posts).Error; err != nil {
+		return nil, 0, wrapError("list posts", err)
+	}
+	return posts, total, nil
+}
+
+// ListByUser returns the posts of a user, oldest first
+func (r *PostRepo) ListByUser(ctx context.Context, userID uint) ([]Post, error) {
+	var posts []Post
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).Order("id").Find(&posts).Error
+	if err != nil {
+		return nil, wrapError(fmt.Sprintf("list posts of user %d", userID), err)
+	}
+	return posts, nil
+}
+
+// Update saves the post if p.Version is still current and increments it.
+// It fails with ErrConflict on a concurrent update and ErrInvalidReference if the author does not exist.
+func (r *PostRepo) Update(ctx context.Context, p *Post) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		ok, err := exists(tx, &Post{}, p.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return gorm.ErrRecordNotFound
+		}
+		if err := checkAuthor(tx, p.UserID); err != nil {
+			return err
+		}
+		res := tx.Model(p).Where("version = ?", p.Version).Updates(map[string]any{
+			"user_id": p.UserID,
+			"title":   p.Title,
+			"body":    p.Body,
+			"version": gorm.Expr("version + 1"),
+		})
+		return checkUpdated(res, &Post{}, p.ID)
+	})
+	if err != nil {
+		return wrapError(fmt.Sprintf("update post %d", p.ID), err)
+	}
+	p.Version++
+	return nil
+}
+
+func (r *PostRepo) Delete(ctx context.Context, id uint) error {
+	res := r.db.WithContext(ctx).Delete(&Post{ID: id})
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = gorm.ErrRecordNotFound
+	}
+	return wrapError(fmt.Sprintf("delete post %d", id), res.Error)
+}
+
+// checkAuthor returns ErrInvalidReference if there is no user with the given ID
+func checkAuthor(db *gorm.DB, userID uint) error {
+	ok, err := exists(db, &User{}, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("user %d: %w", userID, ErrInvalidReference)
+	}
+	return nil
+}
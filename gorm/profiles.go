@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ProfileRepo stores the one-to-one profile of a user
+type ProfileRepo struct {
+	db *gorm.DB
+}
+
+func NewProfileRepo(db *gorm.DB) *ProfileRepo {
+	return &ProfileRepo{db: db}
+}
+
+// GetByUser loads the profile of a user
+func (r *ProfileRepo) GetByUser(ctx context.Context, userID uint) (*Profile, error) {
+	var p Profile
+	if err := r.db.WithContext(ctx).First(&p, "user_id = ?", userID).Error; err != nil {
+		return nil, wrapError(fmt.Sprintf("get profile of user %d", userID), err)
+	}
+	return &p, nil
+}
+
+// Save creates or replaces the profile of p.UserID, it fails with ErrInvalidReference if the user does not exist
+func (r *ProfileRepo) Save(ctx context.Context, p *Profile) error {
+	op := fmt.Sprintf("save profile of user %d", p.UserID)
+	return wrapError(op, r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkAuthor(tx, p.UserID); err != nil {
+			return err
+		}
+		var existing Profile
+		err := tx.Where("user_id = ?", p.UserID).Limit(1).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		// Save writes every column, the tenant included
+		p.ID, p.TenantID = existing.ID, existing.TenantID
+		return tx.Save(p).Error
+	}))
+}
+
+// DeleteByUser removes the profile of a user
+func (r *ProfileRepo) DeleteByUser(ctx context.Context, userID uint) error {
+	res := r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&Profile{})
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = gorm.ErrRecordNotFound
+	}
+	return wrapError(fmt.Sprintf("delete profile of user %d", userID), res.Error)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Errors returned by the repositories, check them with errors.Is
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrDuplicate        = errors.New("already exists")
+	ErrInvalidReference = errors.New("referenced record does not exist")
+	ErrConflict         = errors.New("modified concurrently, reload and retry")
+)
+
+// wrapError maps GORM errors to the repository errors and adds the failed operation to the message.
+// The DB must be opened with TranslateError so that unique violations surface as gorm.ErrDuplicatedKey.
+func wrapError(op string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return fmt.Errorf("%s: %w", op, ErrNotFound)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return fmt.Errorf("%s: %w", op, ErrDuplicate)
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		return fmt.Errorf("%s: %w", op, ErrInvalidReference)
+	default:
+		return fmt.Errorf("%s: %w", op, err)
+	}
+}
+
+// Repos groups the repositories sharing one connection or transaction
+type Repos struct {
+	Users    *UserRepo
+	Profiles *ProfileRepo
+	Posts    *PostRepo
+	Groups   *GroupRepo
+}
+
+// NewRepos builds the repositories on top of db
+func NewRepos(db *gorm.DB) Repos {
+	return Repos{
+		Users:    NewUserRepo(db),
+		Profiles: NewProfileRepo(db),
+		Posts:    NewPostRepo(db),
+		Groups:   NewGroupRepo(db),
+	}
+}
+
+// Page selects a slice of a listing, Limit <= 0 means no limit
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// paginated applies the page to a query
+func paginated(db *gorm.DB, p Page) *gorm.DB {
+	if p.Limit > 0 {
+		db = db.Limit(p.Limit)
+	}
+	return db.Offset(p.Offset)
+}
+
+// exists reports whether a row with the given primary key exists, used to validate references
+// without relying on the database enforcing foreign keys (SQLite does not by default)
+func exists(db *gorm.DB, model any, id uint) (bool, error) {
+	var n int64
+	err := db.Model(model).Where("id = ?", id).Count(&n).Error
+	return n > 0, err
+}
+
+// checkUpdated turns a versioned update that matched no row into ErrConflict if the row
+// exists (someone else updated it first) or gorm.ErrRecordNotFound if it does not
+func checkUpdated(res *gorm.DB, model any, id uint) error {
+	if res.Error != nil || res.RowsAffected > 0 {
+		return res.Error
+	}
+	ok, err := exists(res.Session(&gorm.Session{NewDB: true}), model, id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return ErrConflict
+	}
+	return gorm.ErrRecordNotFound
+}
+
+// UnitOfWork runs several repository calls in a single transaction
+type UnitOfWork struct {
+	db *gorm.DB
+}
+
+func NewUnitOfWork(db *gorm.DB) *UnitOfWork {
+	return &UnitOfWork{db: db}
+}
+
+// Do calls fn with repositories bound to a new transaction, which is committed if fn returns nil and rolled back otherwise
+func (u *UnitOfWork) Do(ctx context.Context, fn func(r Repos) error) error {
+	return u.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(NewRepos(tx))
+	})
+}
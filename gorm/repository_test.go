@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testCtx scopes the repository tests to tenant 1
+var testCtx = WithTenant(context.Background(), 1)
+
+// testDSN is the database the tests also run against besides SQLite, e.g. postgres://... or
+// mysql://... (see dialector). Its tables are dropped before every test, so it must be a throwaway one.
+var testDSN = os.Getenv("TEST_DB_DSN")
+
+// forEachDB runs test as a subtest against SQLite, dsn being empty, and against testDSN if set
+func forEachDB(t *testing.T, test func(t *testing.T, dsn string)) {
+	t.Run("sqlite", func(t *testing.T) { test(t, "") })
+	if testDSN != "" {
+		t.Run(dialector(testDSN).Name(), func(t *testing.T) { test(t, testDSN) })
+	}
+}
+
+// newTestDB opens the database behind dsn after dropping its tables, or with an empty dsn a fresh
+// in-memory SQLite database private to the test. A named shared-cache DSN keeps the data visible
+// to every pooled connection.
+func newTestDB(t testing.TB, dsn string) *gorm.DB {
+	t.Helper()
+	if dsn == "" {
+		name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+		dsn = fmt.Sprintf("file:%s?mode=memory&cache=shared", name)
+	} else {
+		resetTestDB(t, dsn)
+	}
+	db, err := openDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	// Expected errors (not found, duplicates) would otherwise be logged by every test
+	return db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})
+}
+
+// resetTestDB drops every table of the database behind dsn
+func resetTestDB(t testing.TB, dsn string) {
+	t.Helper()
+	db, err := connect(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Join tables first, then the tables they and posts/profiles point to
+	order := []string{"user_groups", "posts", "profiles", "groups", "users"}
+	for _, table := range tables {
+		if !slices.Contains(order, table) {
+			order = append(order, table)
+		}
+	}
+	for _, table := range order {
+		if slices.Contains(tables, table) {
+			if err := db.Migrator().DropTable(table); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestUserRepo(t *testing.T) {
+	forEachDB(t, testUserRepo)
+}
+
+func testUserRepo(t *testing.T, dsn string) {
+	ctx := testCtx
+	r := NewRepos(newTestDB(t, dsn))
+
+	u := &User{Name: "Alice", Email: "alice@example.com", Profile: &Profile{Bio: "Developer"}}
+	if err := r.Users.Create(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Posts.Create(ctx, &Post{UserID: u.ID, Title: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.Users.Get(ctx, u.ID, "Profile", "Posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Profile.Bio != "Developer" || len(got.Posts) != 1 {
+		t.Fatalf("expected preloaded profile and 1 post, got %+v", got)
+	}
+
+	got.Name = "Alice Smith"
+	if err := r.Users.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.Users.GetByEmail(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Alice Smith" {
+		t.Fatalf("expected updated name, got %q", got.Name)
+	}
+
+	if err := r.Users.Delete(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Users.Get(ctx, u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if posts, err := r.Posts.ListByUser(ctx, u.ID); err != nil || len(posts) != 0 {
+		t.Fatalf("expected posts to be deleted with the user, got %v, %v", posts, err)
+	}
+	if err := r.Users.Delete(ctx, u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound deleting twice, got %v", err)
+	}
+}
+
+var notFoundCases = []struct {
+	name string
+	call func(ctx context.Context, r Repos) error
+}{
+	{"get user", func(ctx context.Context, r Repos) error { _, err := r.Users.Get(ctx, 42); return err }},
+	{"get user by email", func(ctx context.Context, r Repos) error {
+		_, err := r.Users.GetByEmail(ctx, "nobody@example.com")
+		return err
+	}},
+	{"update user", func(ctx context.Context, r Repos) error { return r.Users.Update(ctx, &User{ID: 42, Email: "x"}) }},
+	{"get post", func(ctx context.Context, r Repos) error { _, err := r.Posts.Get(ctx, 42); return err }},
+	{"update post", func(ctx context.Context, r Repos) error { return r.Posts.Update(ctx, &Post{ID: 42}) }},
+	{"delete post", func(ctx context.Context, r Repos) error { return r.Posts.Delete(ctx, 42) }},
+	{"get group", func(ctx context.Context, r Repos) error { _, err := r.Groups.Get(ctx, 42, true); return err }},
+	{"get group by name", func(ctx context.Context, r Repos) error { _, err := r.Groups.GetByName(ctx, "nobody"); return err }},
+	{"add member", func(ctx context.Context, r Repos) error { return r.Groups.AddMember(ctx, 42, 42) }},
+	{"delete group", func(ctx context.Context, r Repos) error { return r.Groups.Delete(ctx, 42) }},
+}
+
+func TestNotFound(t *testing.T) {
+	forEachDB(t, testNotFound)
+}
+
+func testNotFound(t *testing.T, dsn string) {
+	ctx := testCtx
+	r := NewRepos(newTestDB(t, dsn))
+	for _, tc := range notFoundCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.call(ctx, r); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUniqueViolations(t *testing.T) {
+	forEachDB(t, testUniqueViolations)
+}
+
+func testUniqueViolations(t *testing.T, dsn string) {
+	ctx := testCtx
+	r := NewRepos(newTestDB(t, dsn))
+
+	if err := r.Users.Create(ctx, &User{Name: "Alice", Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	err := r.Users.Create(ctx, &User{Name: "Other Alice", Email: "alice@example.com"})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for email, got %v", err)
+	}
+
+	if err := r.Groups.Create(ctx, &Group{Name: "Developers"}); err != nil {
+		t.Fatal(err)
+	}
+	err = r.Groups.Create(ctx, &Group{Name: "Developers"})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate for group name, got %v", err)
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	forEachDB(t, testGroupMembers)
+}
+
+func testGroupMembers(t *testing.T, dsn string) {
+	ctx := testCtx
+	r := NewRepos(newTestDB(t, dsn))
+
+	u := &User{Name: "Bob", Email: "bob@example.com"}
+	g := &Group{Name: "Data Scientists"}
+	if err := r.Users.Create(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Groups.Create(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Groups.AddMember(ctx, g.ID, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Groups.AddMember(ctx, g.ID, 42); !errors.Is(err, ErrInvalidReference) {
+		t.Fatalf("expected ErrInvalidReference for missing user, got %v", err)
+	}
+
+	got, err := r.Groups.Get(ctx, g.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Users) != 1 || got.Users[0].ID != u.ID {
+		t.Fatalf("expected Bob to be the only member, got %+v", got.Users)
+	}
+
+	if err := r.Groups.RemoveMember(ctx, g.ID, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	withGroups, err := r.Users.Get(ctx, u.ID, "Groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withGroups.Groups) != 0 {
+		t.Fatalf("expected no groups after removal, got %+v", withGroups.Groups)
+	}
+}
+
+func TestUnitOfWorkRollback(t *testing.T) {
+	forEachDB(t, testUnitOfWorkRollback)
+}
+
+func testUnitOfWorkRollback(t *testing.T, dsn string) {
+	ctx := testCtx
+	db := newTestDB(t, dsn)
+
+	err := NewUnitOfWork(db).Do(ctx, func(r Repos) error {
+		if err := r.Users.Create(ctx, &User{Name: "Alice", Email: "alice@example.com"}); err != nil {
+			return err
+		}
+		// Fails on the unique email and must roll back the first insert as well
+		return r.Users.Create(ctx, &User{Name: "Alice again", Email: "alice@example.com"})
+	})
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate from the transaction, got %v", err)
+	}
+	if _, err := NewUserRepo(db).GetByEmail(ctx, "alice@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the transaction to be rolled back, got %v", err)
+	}
+}
+
+func TestCanceledContext(t *testing.T) {
+	forEachDB(t, testCanceledContext)
+}
+
+func testCanceledContext(t *testing.T, dsn string) {
+	ctx, cancel := context.WithCancel(testCtx)
+	cancel()
+	r := NewRepos(newTestDB(t, dsn))
+	err := r.Users.Create(ctx, &User{Name: "Alice", Email: "alice@example.com"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Errors returned when a statement on tenant-scoped data cannot be scoped
+var (
+	ErrNoTenant       = errors.New("no tenant in context")
+	ErrTenantMismatch = errors.New("record belongs to another tenant")
+)
+
+type tenantKey struct{}
+
+// allTenants is stored instead of a tenant ID by AllTenants
+const allTenants = ^uint(0)
+
+// WithTenant returns a context whose queries only see and write rows of the given tenant
+func WithTenant(ctx context.Context, tenantID uint) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// AllTenants returns a context that bypasses tenant scoping, for maintenance jobs such as seeding.
+// Rows created with it must have their TenantID set explicitly.
+func AllTenants(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantKey{}, allTenants)
+}
+
+func tenantFrom(ctx context.Context) (uint, bool) {
+	id, ok := ctx.Value(tenantKey{}).(uint)
+	return id, ok && id != 0
+}
+
+// Join tables of many2many associations between tenant-scoped models, with the tables their keys point to
+var tenantJoinTables = map[string]map[string]string{
+	"user_groups": {"group_id": "groups", "user_id": "users"},
+}
+
+// registerTenancy installs the callbacks scoping every statement on a model with a TenantID field
+// (and on the join tables between them) to the tenant of the statement's context.
+// Raw SQL (db.Raw, db.Exec) is not scoped.
+func registerTenancy(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("tenant:create", tenantCreate),
+		cb.Query().Before("gorm:query").Register("tenant:query", tenantScope),
+		cb.Row().Before("gorm:row").Register("tenant:row", tenantScope),
+		cb.Update().Before("gorm:update").Register("tenant:update", tenantScope),
+		cb.Delete().Before("gorm:delete").Register("tenant:delete", tenantScope),
+	} {
+		if err != nil {
+			return fmt.Errorf("register tenant callbacks: %w", err)
+		}
+	}
+	return nil
+}
+
+// tenantField returns the TenantID field of the statement's model, or nil if the model is not tenant-scoped
+func tenantField(db *gorm.DB) *schema.Field {
+	if db.Statement.Schema == nil {
+		return nil
+	}
+	return db.Statement.Schema.LookUpField("TenantID")
+}
+
+// statementTenant returns the tenant to scope the statement to, or false if it must not be scoped
+func statementTenant(db *gorm.DB) (uint, bool) {
+	tenantID, ok := tenantFrom(db.Statement.Context)
+	if !ok {
+		db.AddError(fmt.Errorf("%s: %w", db.Statement.Table, ErrNoTenant))
+		return 0, false
+	}
+	return tenantID, tenantID != allTenants
+}
+
+// tenantScope restricts queries, updates and deletes to the rows of the context's tenant
+func tenantScope(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	if f := tenantField(db); f != nil {
+		if tenantID, ok := statementTenant(db); ok {
+			db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+				clause.Eq{Column: clause.Column{Table: db.Statement.Table, Name: f.DBName}, Value: tenantID},
+			}})
+		}
+		return
+	}
+	if refs, ok := tenantJoinTables[db.Statement.Table]; ok {
+		if tenantID, ok := statementTenant(db); ok {
+			// Only join rows whose both ends belong to the tenant
+			for column, table := range refs {
+				db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+					clause.Expr{
+						SQL:  "? IN (SELECT id FROM ? WHERE tenant_id = ?)",
+						Vars: []any{clause.Column{Table: db.Statement.Table, Name: column}, clause.Table{Name: table}, tenantID},
+					},
+				}})
+			}
+		}
+	}
+}
+
+// tenantCreate stamps new rows with the context's tenant, and checks that new join rows
+// only link records of that tenant
+func tenantCreate(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	if f := tenantField(db); f != nil {
+		tenantID, scoped := statementTenant(db)
+		if db.Error != nil {
+			return
+		}
+		eachModel(db, func(rv reflect.Value) {
+			current, zero := f.ValueOf(db.Statement.Context, rv)
+			switch {
+			case !scoped && zero:
+				db.AddError(fmt.Errorf("%s: %w", db.Statement.Table, ErrNoTenant))
+			case !scoped:
+			case zero:
+				if err := f.Set(db.Statement.Context, rv, tenantID); err != nil {
+					db.AddError(err)
+				}
+			case current.(uint) != tenantID:
+				db.AddError(fmt.Errorf("%s: %w", db.Statement.Table, ErrTenantMismatch))
+			}
+		})
+		return
+	}
+	if refs, ok := tenantJoinTables[db.Statement.Table]; ok {
+		tenantID, scoped := statementTenant(db)
+		if !scoped || db.Statement.Schema == nil {
+			return
+		}
+		for column, table := range refs {
+			f := db.Statement.Schema.LookUpField(column)
+			if f == nil {
+				continue
+			}
+			ids := map[any]bool{}
+			eachModel(db, func(rv reflect.Value) {
+				if v, zero := f.ValueOf(db.Statement.Context, rv); !zero {
+					ids[v] = true
+				}
+			})
+			keys := make([]any, 0, len(ids))
+			for id := range ids {
+				keys = append(keys, id)
+			}
+			var n int64
+			err := db.Session(&gorm.Session{NewDB: true}).Table(table).
+				Where("id IN ? AND tenant_id = ?", keys, tenantID).Count(&n).Error
+			if err != nil {
+				db.AddError(err)
+				return
+			}
+			if int(n) != len(keys) {
+				db.AddError(fmt.Errorf("%s: %w", db.Statement.Table, ErrTenantMismatch))
+				return
+			}
+		}
+	}
+}
+
+// eachModel calls fn for every struct the statement writes
+func eachModel(db *gorm.DB, fn func(rv reflect.Value)) {
+	switch rv := reflect.Indirect(db.Statement.ReflectValue); rv.Kind() {
+	case reflect.Struct:
+		fn(rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			fn(reflect.Indirect(rv.Index(i)))
+		}
+	}
+}
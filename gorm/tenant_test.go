@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	forEachDB(t, testTenantIsolation)
+}
+
+func testTenantIsolation(t *testing.T, dsn string) {
+	db := newTestDB(t, dsn)
+	r := NewRepos(db)
+	acme, globex := WithTenant(context.Background(), 1), WithTenant(context.Background(), 2)
+
+	alice := &User{Name: "Alice", Email: "alice@acme.com"}
+	post := &Post{Title: "Acme news"}
+	devs := &Group{Name: "Acme devs"}
+	if err := r.Users.Create(acme, alice); err != nil {
+		t.Fatal(err)
+	}
+	post.UserID = alice.ID
+	if err := r.Posts.Create(acme, post); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Groups.Create(acme, devs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Groups.AddMember(acme, devs.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Profiles.Save(acme, &Profile{UserID: alice.ID, Bio: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	bob := &User{Name: "Bob", Email: "bob@globex.com"}
+	if err := r.Users.Create(globex, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"get user", func() error { _, err := r.Users.Get(globex, alice.ID); return err }, ErrNotFound},
+		{"get user by email", func() error { _, err := r.Users.GetByEmail(globex, alice.Email); return err }, ErrNotFound},
+		{"update user", func() error { return r.Users.Update(globex, &User{ID: alice.ID, Email: "x", Version: 1}) }, ErrNotFound},
+		{"delete user", func() error { return r.Users.Delete(globex, alice.ID) }, ErrNotFound},
+		{"get profile", func() error { _, err := r.Profiles.GetByUser(globex, alice.ID); return err }, ErrNotFound},
+		{"delete profile", func() error { return r.Profiles.DeleteByUser(globex, alice.ID) }, ErrNotFound},
+		{"save profile of other tenant's user", func() error { return r.Profiles.Save(globex, &Profile{UserID: alice.ID}) }, ErrInvalidReference},
+		{"get post", func() error { _, err := r.Posts.Get(globex, post.ID); return err }, ErrNotFound},
+		{"update post", func() error { return r.Posts.Update(globex, &Post{ID: post.ID, UserID: bob.ID, Version: 1}) }, ErrNotFound},
+		{"delete post", func() error { return r.Posts.Delete(globex, post.ID) }, ErrNotFound},
+		{"create post for other tenant's user", func() error { return r.Posts.Create(globex, &Post{UserID: alice.ID}) }, ErrInvalidReference},
+		{"get group", func() error { _, err := r.Groups.Get(globex, devs.ID, true); return err }, ErrNotFound},
+		{"add member to other tenant's group", func() error { return r.Groups.AddMember(globex, devs.ID, bob.ID) }, ErrNotFound},
+		{"add other tenant's user", func() error { return r.Groups.AddMember(acme, devs.ID, bob.ID) }, ErrInvalidReference},
+		{"delete group", func() error { return r.Groups.Delete(globex, devs.ID) }, ErrNotFound},
+		{"create with other tenant's ID", func() error { return r.Users.Create(globex, &User{TenantID: 1, Email: "x"}) }, ErrTenantMismatch},
+		{"no tenant", func() error { _, err := r.Users.Get(context.Background(), alice.ID); return err }, ErrNoTenant},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.call(); !errors.Is(err, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	users, total, err := r.Users.List(globex, Page{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(users) != 1 || users[0].ID != bob.ID {
+		t.Fatalf("expected tenant 2 to list only Bob, got %d: %+v", total, users)
+	}
+
+	// Removing a member through another tenant must not touch the join table
+	if err := r.Groups.RemoveMember(globex, devs.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Users.Get(acme, alice.ID, "Profile", "Posts", "Groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Profile == nil || got.Profile.Bio != "secret" || len(got.Posts) != 1 || len(got.Groups) != 1 {
+		t.Fatalf("expected Alice to keep her profile, post and group, got %+v", got)
+	}
+
+	logs, _, err := NewAuditRepo(db).List(globex, "users", alice.ID, Page{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 0 {
+		t.Fatalf("expected tenant 2 not to see tenant 1's audit log, got %+v", logs)
+	}
+
+	// AllTenants sees everything, for maintenance jobs
+	if _, total, err := r.Users.List(AllTenants(context.Background()), Page{Limit: 10}); err != nil || total != 2 {
+		t.Fatalf("expected 2 users across tenants, got %d, %v", total, err)
+	}
+
+	// Emails and group names are only unique within a tenant
+	if err := r.Users.Create(globex, &User{Name: "Alice", Email: alice.Email}); err != nil {
+		t.Fatalf("expected tenant 2 to reuse tenant 1's email, got %v", err)
+	}
+	if err := r.Groups.Create(globex, &Group{Name: devs.Name}); err != nil {
+		t.Fatalf("expected tenant 2 to reuse tenant 1's group name, got %v", err)
+	}
+	if err := r.Users.Create(globex, &User{Email: alice.Email}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate within tenant 2, got %v", err)
+	}
+}
+
+func TestAPITenantHeader(t *testing.T) {
+	forEachDB(t, testAPITenantHeader)
+}
+
+func testAPITenantHeader(t *testing.T, dsn string) {
+	app := newAPI(newTestDB(t, dsn), TrustedHeaders)
+	seedAPI(t, app)
+
+	for _, tc := range []struct {
+		tenant string
+		status int
+	}{
+		{"", fiber.StatusBadRequest},
+		{"abc", fiber.StatusBadRequest},
+		{"0", fiber.StatusBadRequest},
+		{"1", fiber.StatusOK},
+		{"2", fiber.StatusNotFound},
+	} {
+		if status, body := tenantRequest(t, app, tc.tenant, fiber.MethodGet, "/users/1", ""); status != tc.status {
+			t.Fatalf("tenant %q: expected status %d, got %d (%s)", tc.tenant, tc.status, status, body)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserRepo stores users together with their profile
+type UserRepo struct {
+	db *gorm.DB
+}
+
+func NewUserRepo(db *gorm.DB) *UserRepo {
+	return &UserRepo{db: db}
+}
+
+// Create inserts the user and its profile, it fails with ErrDuplicate if the email is taken
+func (r *UserRepo) Create(ctx context.Context, u *User) error {
+	err := r.db.WithContext(ctx).Create(u).Error
+	return wrapError(fmt.Sprintf("create user %q", u.Email), err)
+}
+
+// Get loads a user by ID, preloading the given associations (e.g. "Profile", "Posts", "Groups")
+func (r *UserRepo) Get(ctx context.Context, id uint, preload ...string) (*User, error) {
+	var u User
+	err := preloaded(r.db.WithContext(ctx), preload).First(&u, id).Error
+	if err != nil {
+		return nil, wrapError(fmt.Sprintf("get user %d", id), err)
+	}
+	return &u, nil
+}
+
+// GetByEmail loads a user by its unique email
+func (r *UserRepo) GetByEmail(ctx context.Context, email string, preload ...string) (*User, error) {
+	var u User
+	err := preloaded(r.db.WithContext(ctx), preload).First(&u, "email = ?", email).Error
+	if err != nil {
+		return nil, wrapError(fmt.Sprintf("get user %q", email), err)
+	}
+	return &u, nil
+}
+
+// List returns a page of users ordered by ID and the total number of users
+func (r *UserRepo) List(ctx context.Context, p Page) ([]User, int64, error) {
+	var users []User
+	var total int64
+	db := r.db.WithContext(ctx).Model(&User{})
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, wrapError("count users", err)
+	}
+	if err := paginated(db, p).Order("id").Find(&users).Error; err != nil {
+		return nil, 0, wrapError("list users", err)
+	}
+	return users, total, nil
+}
+
+// Update saves the user's own columns if u.Version is still current, associations are left untouched.
+// It fails with ErrConflict if the user was updated since it was read, otherwise u.Version is incremented.
+func (r *UserRepo) Update(ctx context.Context, u *User) error {
+	res := r.db.WithContext(ctx).Model(u).Where("version = ?", u.Version).Updates(map[string]any{
+		"name":    u.Name,
+		"email":   u.Email,
+		"version": gorm.Expr("version + 1"),
+	})
+	if err := checkUpdated(res, &User{}, u.ID); err != nil {
+		return wrapError(fmt.Sprintf("update user %d", u.ID), err)
+	}
+	u.Version++
+	return nil
+}
+
+// Delete removes the user with its profile, posts and group memberships
+func (r *UserRepo) Delete(ctx context.Context, id uint) error {
+	res := r.db.WithContext(ctx).Select(clause.Associations).Delete(&User{ID: id})
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = gorm.ErrRecordNotFound
+	}
+	return wrapError(fmt.Sprintf("delete user %d", id), res.Error)
+}
+
+// preloaded adds a Preload for each association name
+func preloaded(db *gorm.DB, preload []string) *gorm.DB {
+	for _, p := range preload {
+		db = db.Preload(p)
+	}
+	return db
+}